@@ -0,0 +1,93 @@
+package prscd
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pilarjs/prscd/chirp"
+)
+
+// MaxPublishSize limits the size of payload published by REST API.
+const MaxPublishSize = 64 << 10
+
+// apiSender is the sender of messages published by API secret.
+const apiSender = "server"
+
+// authAPIRequest authenticates REST API requests by the verified client
+// certificate, or by the API secret in `Authorization: Bearer <secret>`
+// header, the public key of browsers is not accepted. Returns the realm of
+// the app, and the client id of the caller: the one mapped from the
+// certificate, or `server`.
+func authAPIRequest(w http.ResponseWriter, r *http.Request) (appID, credential, cid string, ok bool) {
+	if cert := chirp.VerifiedClientCertificate(r.TLS); cert != nil {
+		appID, cid, credential, ok = chirp.AuthClientCertificate(cert)
+		if !ok || cid == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "illegal client certificate"})
+			return "", "", "", false
+		}
+		return appID, credential, cid, true
+	}
+
+	secret, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || secret == "" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "api secret or client certificate is required"})
+		return "", "", "", false
+	}
+	if chirp.AuthAPISecret == nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "illegal api secret"})
+		return "", "", "", false
+	}
+	appID, credential, ok = chirp.AuthAPISecret(secret)
+	if !ok {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "illegal api secret"})
+		return "", "", "", false
+	}
+	return appID, credential, apiSender, true
+}
+
+// handlePublish publishes the request body as the payload of a data
+// signalling to all peers of the channel, `POST /v1/channels/{channel}/publish`.
+// The sender is the caller authenticated, not chosen by the request.
+// Responds 404 if the channel does not exist on this node.
+func handlePublish(w http.ResponseWriter, r *http.Request) {
+	appID, credential, cid, ok := authAPIRequest(w, r)
+	if !ok {
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxPublishSize))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+		return
+	}
+
+	channel := r.PathValue("channel")
+	realm := chirp.GetOrCreateRealm(appID, credential)
+	if !realm.Publish(channel, cid, payload) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+	log.Info("api.publish", "appID", appID, "channel", channel, "cid", cid, "size", len(payload))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlePresence lists the peers in the channel on this node,
+// `GET /v1/channels/{channel}/presence`, with the number of connections of
+// each peer and the RTT of peers measured.
+func handlePresence(w http.ResponseWriter, r *http.Request) {
+	appID, credential, _, ok := authAPIRequest(w, r)
+	if !ok {
+		return
+	}
+
+	channel := r.PathValue("channel")
+	realm := chirp.GetOrCreateRealm(appID, credential)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"channel": channel,
+		"peers":   realm.Presence(channel),
+		"conns":   realm.PresenceConns(channel),
+		"rtt":     realm.PresenceRTT(channel),
+	})
+}
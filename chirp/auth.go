@@ -0,0 +1,139 @@
+package chirp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+// ConnectRequest describes the parameters presented by client when connecting.
+type ConnectRequest struct {
+	// Cid is the client id of peer, set by developer.
+	Cid string
+	// AppID is the app which the public key belongs to.
+	AppID string
+	// Credential is used to connect to YoMo.
+	Credential string
+	// Version is the protocol version requested by client.
+	Version psig.Version
+	// CidVerified tells Cid is mapped from the verified client certificate.
+	CidVerified bool
+}
+
+// AuthClientCertificate is used to authenticate server-to-server clients,
+// like IoT gateways and bots, by the client certificate verified in mutual
+// TLS handshake, returns the app and the client id mapped from the subject
+// or SANs of cert. Clients presenting a certificate skip the public key
+// authentication if it is set.
+var AuthClientCertificate func(cert *x509.Certificate) (appID, cid, credential string, ok bool)
+
+// AuthAPISecret is used to authenticate REST API requests from backend
+// services, by the secret in `Authorization: Bearer <secret>` header, returns
+// the app which the secret belongs to. REST API requests are authenticated
+// by the verified client certificate only if it is not set.
+var AuthAPISecret func(secret string) (appID, credential string, ok bool)
+
+// ReservedCid tells if the client id of app is reserved for clients
+// authenticated by certificate, clients authenticated by public key can not
+// take it, so they can not receive the direct and WebRTC signallings to the
+// verified client. Nothing is reserved if it is not set.
+var ReservedCid func(appID, cid string) bool
+
+// ErrCidReserved is returned when a client authenticated by public key
+// takes a client id reserved for certificates.
+var ErrCidReserved = errors.New("client id is reserved for certificate")
+
+// reservedCid tells if cid of app is reserved by ReservedCid.
+func reservedCid(appID, cid string) bool {
+	return ReservedCid != nil && ReservedCid(appID, cid)
+}
+
+// VerifiedClientCertificate returns the client certificate verified in the
+// TLS handshake of state, nil if client does not present one or
+// AuthClientCertificate is not set.
+func VerifiedClientCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if AuthClientCertificate == nil || state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// AuthConnectRequest authenticates the client by the query string of the
+// connecting request, which looks like `/v1?id=xxx&publickey=xxx&v=v2`, or
+// by the verified client certificate of state, and checks the `Origin`
+// header against the allowed origins of the app, and the peer quota of the
+// app. It is shared by all transports served over HTTP, the returned status
+// is the HTTP status code should be responded when error occurs.
+func AuthConnectRequest(query url.Values, origin string, state *tls.ConnectionState) (req *ConnectRequest, status int, err error) {
+	if cert := VerifiedClientCertificate(state); cert != nil {
+		return authClientCertificate(cert, query, origin)
+	}
+
+	req = &ConnectRequest{
+		Cid: query.Get("id"),
+	}
+	if req.Cid == "" {
+		return nil, http.StatusUnauthorized, errors.New("id must not be empty")
+	}
+
+	// publickey can be used for identify user if developer want integrate with other systems
+	publicKey := query.Get("publickey")
+	if publicKey == "" {
+		return nil, http.StatusUnauthorized, errors.New("publickey must not be empty")
+	}
+
+	req.Version, err = psig.ParseVersion(query.Get("v"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	var ok bool
+	req.AppID, req.Credential, ok = AuthUserAndGetYoMoCredential(publicKey)
+	if !ok {
+		return nil, http.StatusForbidden, errors.New("illegal public key")
+	}
+
+	if reservedCid(req.AppID, req.Cid) {
+		return nil, http.StatusForbidden, ErrCidReserved
+	}
+
+	if err := CheckOrigin(req.AppID, origin); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	if err := CheckPeerQuota(req.AppID); err != nil {
+		return nil, http.StatusTooManyRequests, err
+	}
+
+	return req, http.StatusOK, nil
+}
+
+// authClientCertificate authenticates the client by cert, the client id is
+// mapped from cert instead of the `id` query param.
+func authClientCertificate(cert *x509.Certificate, query url.Values, origin string) (req *ConnectRequest, status int, err error) {
+	req = &ConnectRequest{CidVerified: true}
+	req.Version, err = psig.ParseVersion(query.Get("v"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	var ok bool
+	req.AppID, req.Cid, req.Credential, ok = AuthClientCertificate(cert)
+	if !ok || req.Cid == "" {
+		return nil, http.StatusForbidden, errors.New("illegal client certificate")
+	}
+
+	if err := CheckOrigin(req.AppID, origin); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	if err := CheckPeerQuota(req.AppID); err != nil {
+		return nil, http.StatusTooManyRequests, err
+	}
+
+	return req, http.StatusOK, nil
+}
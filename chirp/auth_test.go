@@ -0,0 +1,62 @@
+package chirp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_AuthConnectRequest_ClientCertificate(t *testing.T) {
+	defer func(fn func(*x509.Certificate) (string, string, string, bool)) { AuthClientCertificate = fn }(AuthClientCertificate)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "gateway-1"}, DNSNames: []string{"gw1.iot.example.com"}}
+	state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	query := url.Values{"id": {"spoofed"}}
+
+	// without hook, the public key is required
+	AuthClientCertificate = nil
+	assert(t, VerifiedClientCertificate(state) == nil, "certificate should be ignored without hook")
+	_, status, err := AuthConnectRequest(query, "", state)
+	assert(t, err != nil && status == http.StatusUnauthorized, "publickey should be required, got %d %v", status, err)
+
+	AuthClientCertificate = func(cert *x509.Certificate) (appID, cid, credential string, ok bool) {
+		if cert.Subject.CommonName != "gateway-1" {
+			return "", "", "", false
+		}
+		return "iot-app", cert.DNSNames[0], "cred", true
+	}
+	req, status, err := AuthConnectRequest(query, "", state)
+	assert(t, err == nil && status == http.StatusOK, "certificate should be accepted, got %d %v", status, err)
+	assert(t, req.AppID == "iot-app" && req.Credential == "cred", "app should be mapped from certificate, got %+v", req)
+	assert(t, req.Cid == "gw1.iot.example.com", "cid should be mapped from certificate, got %s", req.Cid)
+
+	// unverified certificates are ignored
+	_, status, _ = AuthConnectRequest(query, "", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	assert(t, status == http.StatusUnauthorized, "unverified certificate should not be trusted, got %d", status)
+
+	cert.Subject.CommonName = "unknown"
+	_, status, err = AuthConnectRequest(query, "", state)
+	assert(t, err != nil && status == http.StatusForbidden, "unknown certificate should be rejected, got %d %v", status, err)
+}
+
+func Test_AuthConnectRequest_ReservedCid(t *testing.T) {
+	defer func(fn func(string, string) bool) { ReservedCid = fn }(ReservedCid)
+	ReservedCid = func(appID, cid string) bool {
+		return strings.HasPrefix(cid, "cert:")
+	}
+
+	_, status, err := AuthConnectRequest(url.Values{"id": {"cert:gw1"}, "publickey": {"pk"}}, "", nil)
+	assert(t, errors.Is(err, ErrCidReserved) && status == http.StatusForbidden, "reserved cid should be refused, got %d %v", status, err)
+	req, _, err := AuthConnectRequest(url.Values{"id": {"alice"}, "publickey": {"pk"}}, "", nil)
+	assert(t, err == nil && req.Cid == "alice", "cid not reserved should be accepted, got %v", err)
+
+	realm := &node{id: "reserved_app", sndr: &MockSender{}}
+	mallory := realm.AddPeer(NewMockConnection("reserved-m"), "mallory")
+	err = realm.setCid(mallory, "cert:gw1")
+	assert(t, errors.Is(err, ErrCidReserved) && mallory.Cid == "mallory", "reserved cid should not be taken by peer_state, got %v", err)
+}
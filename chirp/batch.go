@@ -0,0 +1,159 @@
+package chirp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pilarjs/prscd/psig"
+	"github.com/pilarjs/prscd/util"
+)
+
+// batchOverhead reserves the bytes of the `batch` envelope in size budget.
+const batchOverhead = 32
+
+// batchConfig describes how messages are batched, within window and up to
+// maxBytes in a batch, batching is disabled if window is 0.
+type batchConfig struct {
+	window   time.Duration
+	maxBytes int
+}
+
+// peerBatch returns how messages to peers speaking protocol v3 are batched.
+var peerBatch = sync.OnceValue(func() batchConfig {
+	return batchConfig{
+		window:   max(util.GetEnvDuration("BATCH_WINDOW", 0), 0),
+		maxBytes: util.GetEnvInt("BATCH_MAX_BYTES", 16*1024),
+	}
+})
+
+// meshBatch returns how signallings to other nodes are batched.
+var meshBatch = sync.OnceValue(func() batchConfig {
+	return batchConfig{
+		window:   max(util.GetEnvDuration("MESH_BATCH_WINDOW", 0), 0),
+		maxBytes: util.GetEnvInt("MESH_BATCH_MAX_BYTES", 64*1024),
+	}
+})
+
+// BatchLimiter is implemented by connections which can not carry large
+// messages, e.g. WebTransport datagrams, batches to them are limited to
+// MaxBatchSize bytes.
+type BatchLimiter interface {
+	// MaxBatchSize returns the max bytes of a batch written to the connection.
+	MaxBatchSize() int
+}
+
+// batcher collects the messages written within a window, and flushes them
+// together once the window elapses or the size budget is reached.
+type batcher struct {
+	mu        sync.Mutex
+	msgs      [][]byte
+	size      int
+	scheduled bool
+	flushMu   sync.Mutex // keeps the batches flushed in order
+	flush     func(msgs [][]byte)
+}
+
+// add msg to the batch, the batch pending is flushed first if msg does not
+// fit in it.
+func (b *batcher) add(msg []byte, cfg batchConfig) {
+	b.mu.Lock()
+	if len(b.msgs) > 0 && b.size+len(msg) > cfg.maxBytes-batchOverhead {
+		b.flushLocked()
+		b.mu.Lock()
+	}
+	b.msgs = append(b.msgs, msg)
+	b.size += len(msg) + 1
+	if b.size >= cfg.maxBytes-batchOverhead {
+		b.flushLocked()
+		return
+	}
+	if !b.scheduled {
+		b.scheduled = true
+		time.AfterFunc(cfg.window, func() {
+			b.mu.Lock()
+			b.flushLocked()
+		})
+	}
+	b.mu.Unlock()
+}
+
+// flushLocked takes the batch pending and flushes it, b.mu is held by caller
+// and released.
+func (b *batcher) flushLocked() {
+	msgs := b.msgs
+	b.msgs = nil
+	b.size = 0
+	b.scheduled = false
+	if len(msgs) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.flushMu.Lock()
+	b.mu.Unlock()
+	defer b.flushMu.Unlock()
+	b.flush(msgs)
+}
+
+// write msg to this peer, batched with others if this peer speaks protocol
+// v3 and batching is enabled.
+func (p *Peer) write(msg []byte) error {
+	cfg := peerBatch()
+	if cfg.window == 0 || !p.Version.SupportsBatch() {
+		return p.conn.Write(msg)
+	}
+	if l, ok := p.conn.(BatchLimiter); ok {
+		cfg.maxBytes = min(cfg.maxBytes, l.MaxBatchSize())
+	}
+	p.batchOnce.Do(func() {
+		p.batch.flush = p.writeBatch
+	})
+	p.batch.add(msg, cfg)
+	return nil
+}
+
+// writeBatch writes msgs to the connection, in a `batch` envelope if more
+// than one.
+func (p *Peer) writeBatch(msgs [][]byte) {
+	msg := msgs[0]
+	if len(msgs) > 1 {
+		var err error
+		if msg, err = p.Codec.MarshalBatch(msgs); err != nil {
+			log.Error("marshal batch error", "codec", p.Codec.Name(), "err", err)
+			return
+		}
+		stats.Add("batched_local", int64(len(msgs)))
+	}
+	if err := p.conn.Write(msg); err != nil {
+		log.Error("batch.write error", "sid", p.Sid, "messages", len(msgs), "err", err)
+	}
+}
+
+// sendToYoMo sends the signalling encoded to other nodes, batched with
+// others of this realm if enabled.
+func (n *node) sendToYoMo(buf []byte) {
+	cfg := meshBatch()
+	if cfg.window == 0 {
+		n.writeToYoMo(0x20, buf)
+		return
+	}
+	n.batchOnce.Do(func() {
+		n.batch.flush = n.writeBatchToYoMo
+	})
+	n.batch.add(buf, cfg)
+}
+
+// writeBatchToYoMo sends msgs to other nodes, in a `batch` envelope tagged
+// 0x22 if more than one.
+func (n *node) writeBatchToYoMo(msgs [][]byte) {
+	if len(msgs) == 1 {
+		n.writeToYoMo(0x20, msgs[0])
+		return
+	}
+	buf, err := psig.Msgpack.MarshalBatch(msgs)
+	if err != nil {
+		log.Error("marshal batch error", "err", err)
+		return
+	}
+	stats.Add("batched_mesh", int64(len(msgs)))
+	n.writeToYoMo(0x22, buf)
+}
@@ -0,0 +1,147 @@
+package chirp
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pilarjs/prscd/psig"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/yomorun/yomo/core/frame"
+)
+
+// limitedConnection limits the size of batches written to it.
+type limitedConnection struct {
+	recordConnection
+	limit int
+}
+
+func (c *limitedConnection) MaxBatchSize() int { return c.limit }
+
+// waitCount waits until conn records n messages.
+func waitCount(t *testing.T, conn *recordConnection, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for conn.count() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("should record %d messages, got %d", n, conn.count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_PeerBatch(t *testing.T) {
+	defer func(fn func() batchConfig) { peerBatch = fn }(peerBatch)
+	peerBatch = func() batchConfig {
+		return batchConfig{window: 20 * time.Millisecond, maxBytes: 16 * 1024}
+	}
+
+	realm := &node{id: "batch_app", sndr: &MockSender{}}
+	v3Conn := newRecordConnection("batch-v3")
+	v3 := realm.AddPeer(v3Conn, "carol")
+	v3.Version = psig.V3
+	v3.Codec = psig.JSON
+	v2Conn := newRecordConnection("batch-v2")
+	realm.AddPeer(v2Conn, "dave").Join("batch-room")
+	v3.Join("batch-room")
+	waitCount(t, v3Conn, 1)
+	v3Conn.msgs = nil
+	v2Conn.msgs = nil
+
+	c := realm.FindChannel("batch-room")
+	for _, pl := range []string{"1", "2", "3"} {
+		c.Dispatch(&psig.Signalling{Type: psig.SigData, Channel: "batch-room", Cid: "alice", Payload: []byte(pl)})
+	}
+	assert(t, v2Conn.count() == 3, "v2 peer should get single signals, got %d", v2Conn.count())
+	assert(t, v3Conn.count() == 0, "v3 peer should get nothing within the window, got %d", v3Conn.count())
+
+	waitCount(t, v3Conn, 1)
+	var sig psig.Signalling
+	if err := psig.JSON.Decode(bytes.NewReader(v3Conn.msgs[0]), &sig); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, sig.Type == psig.SigBatch && payloadsOf(sig.Batch) == "123", "batch of signals in order, got %+v", sig)
+
+	// a single signal within the window is not wrapped
+	v3Conn.msgs = nil
+	c.Dispatch(&psig.Signalling{Type: psig.SigData, Channel: "batch-room", Cid: "alice", Payload: []byte("4")})
+	waitCount(t, v3Conn, 1)
+	sig = psig.Signalling{}
+	psig.JSON.Decode(bytes.NewReader(v3Conn.msgs[0]), &sig)
+	assert(t, sig.Type == psig.SigData && string(sig.Payload) == "4", "single signal, got %+v", sig)
+}
+
+func Test_PeerBatchSizeBudget(t *testing.T) {
+	defer func(fn func() batchConfig) { peerBatch = fn }(peerBatch)
+	peerBatch = func() batchConfig {
+		return batchConfig{window: time.Hour, maxBytes: 16 * 1024}
+	}
+
+	realm := &node{id: "batch_size_app", sndr: &MockSender{}}
+	conn := &limitedConnection{recordConnection: *newRecordConnection("batch-wt"), limit: 220}
+	p := realm.AddPeer(conn, "carol")
+	p.Version = psig.V3
+
+	msg, _ := p.Codec.Marshal(&psig.Signalling{Type: psig.SigData, Channel: "batch-room", Cid: "alice", Payload: bytes.Repeat([]byte("x"), 50)})
+	for range 5 {
+		p.write(msg)
+	}
+	// flushed once the budget is reached, without waiting for the window
+	assert(t, conn.count() == 2, "batches should be flushed by size, got %d", conn.count())
+	for _, buf := range conn.msgs {
+		var sig psig.Signalling
+		if err := psig.Msgpack.Decode(bytes.NewReader(buf), &sig); err != nil {
+			t.Fatal(err)
+		}
+		assert(t, len(buf) <= conn.limit && sig.Type == psig.SigBatch && len(sig.Batch) == 2, "batch should fit in limit, got %d bytes, %d signals", len(buf), len(sig.Batch))
+	}
+}
+
+// tagSender records the tags and data written to it.
+type tagSender struct {
+	MockSender
+	mu   sync.Mutex
+	tags []frame.Tag
+	data [][]byte
+}
+
+func (s *tagSender) Write(tag frame.Tag, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags = append(s.tags, tag)
+	s.data = append(s.data, data)
+	return nil
+}
+
+func Test_MeshBatch(t *testing.T) {
+	defer func(fn func() batchConfig) { meshBatch = fn }(meshBatch)
+	meshBatch = func() batchConfig {
+		return batchConfig{window: 10 * time.Millisecond, maxBytes: 64 * 1024}
+	}
+
+	sndr := &tagSender{}
+	realm := &node{id: "mesh_batch_app", sndr: sndr}
+	for _, pl := range []string{"a", "b", "c"} {
+		realm.BroadcastToYoMo(&psig.Signalling{Type: psig.SigData, Channel: "mesh-room", Cid: "alice", Payload: []byte(pl)})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	sndr.mu.Lock()
+	defer sndr.mu.Unlock()
+	assert(t, len(sndr.tags) == 1 && sndr.tags[0] == 0x22, "signals should be sent in a batch, got tags %v", sndr.tags)
+	var sig psig.Signalling
+	if err := msgpack.Unmarshal(sndr.data[0], &sig); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, sig.Type == psig.SigBatch && payloadsOf(sig.Batch) == "abc", "batch of signals in order, got %+v", sig)
+
+	// batch received from other nodes is dispatched in order
+	conn := newRecordConnection("mesh-batch-b")
+	realm.AddPeer(conn, "bob").Join("mesh-room")
+	conn.msgs = nil
+	for _, s := range sig.Batch {
+		realm.handleFromYoMo(s)
+	}
+	assert(t, conn.count() == 3, "batched signals should be dispatched, got %d", conn.count())
+}
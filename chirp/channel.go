@@ -3,18 +3,27 @@ package chirp
 
 import (
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pilarjs/prscd/psig"
 	"github.com/pilarjs/prscd/util"
-	"github.com/vmihailenco/msgpack/v5"
 )
 
 // Channel describes a message channel.
 type Channel struct {
-	UniqID string   // uniq id
-	pdic   sync.Map // all peers subscribed this channel
-	realm  *node    // the node which this channel belongs to
+	UniqID  string             // uniq id
+	pdic    sync.Map           // all peers subscribed this channel
+	realm   *node              // the node which this channel belongs to
+	seq     atomic.Uint64      // sequence number of the latest data signalling published on this node
+	members memberRegistry     // connections of client ids on all nodes
+	calls   callRegistry       // WebRTC calls between peers
+	updates coalescer          // updates pending to publish if coalescing
+	outMu   sync.Mutex         // guards out and sending
+	out     []*psig.Signalling // messages pending to send to other nodes, in order published
+	sending bool               // out is being sent
 }
 
 // AddPeer add peer to this channel.
@@ -22,9 +31,16 @@ func (c *Channel) AddPeer(p *Peer) {
 	c.pdic.Store(p.Sid, p)
 }
 
-// RemovePeer remove peer from this channel.
+// RemovePeer remove peer from this channel, unless it is replaced by another
+// peer of the same sid.
 func (c *Channel) RemovePeer(p *Peer) {
-	c.pdic.Delete(p.Sid)
+	c.pdic.CompareAndDelete(p.Sid, p)
+}
+
+// hasPeer tells if p subscribed this channel.
+func (c *Channel) hasPeer(p *Peer) bool {
+	v, ok := c.pdic.Load(p.Sid)
+	return ok && v.(*Peer) == p
 }
 
 // Broadcast message to all peers in this channel by yomo,
@@ -32,10 +48,86 @@ func (c *Channel) RemovePeer(p *Peer) {
 // will connect to different nodes in this network, so the message will be
 // broadcast to all nodes.
 func (c *Channel) Broadcast(sig *psig.Signalling) {
-	sigSentOverYoMo := sig.Clone()
-	sigSentOverYoMo.AppID = c.realm.id
-	sigSentOverYoMo.MeshID = os.Getenv("MESH_ID")
-	go c.realm.BroadcastToYoMo(&sigSentOverYoMo)
+	if tick := c.coalesceTick(); tick > 0 {
+		if key := coalesceKey(sig); key != "" {
+			update := sig.Clone()
+			c.updates.add(key, &update, tick, c.publish)
+			return
+		}
+		// keep the order with updates pending
+		c.publish(append(c.updates.take(), sig)...)
+		return
+	}
+	c.publish(sig)
+}
+
+// bootEpoch tells the runs of this process apart.
+var bootEpoch = strconv.FormatInt(time.Now().UnixMilli(), 36)
+
+// seqOrigin returns the origin stamped on data signallings published on this
+// node, the mesh id with the time this process started, as the sequence
+// numbers start over on restart. It is empty if `MESH_ID` is not set.
+func seqOrigin() string {
+	meshID := os.Getenv("MESH_ID")
+	if meshID == "" {
+		return ""
+	}
+	return meshID + ":" + bootEpoch
+}
+
+// warnNoOrigin tells once that data signallings are not numbered, as
+// `MESH_ID` is not set.
+var warnNoOrigin = sync.OnceFunc(func() {
+	log.Error("MESH_ID is not set, data signallings are sent without seq and origin")
+})
+
+// publish the messages to all nodes by yomo, in order.
+func (c *Channel) publish(sigs ...*psig.Signalling) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	for _, sig := range sigs {
+		sigSentOverYoMo := sig.Clone()
+		sigSentOverYoMo.AppID = c.realm.id
+		sigSentOverYoMo.MeshID = os.Getenv("MESH_ID")
+		c.out = append(c.out, &sigSentOverYoMo)
+	}
+	if !c.sending {
+		c.sending = true
+		go c.send()
+	}
+}
+
+// send the messages published until none is pending, by one goroutine per
+// channel at a time, so they are stamped and sent in the order published.
+func (c *Channel) send() {
+	for {
+		c.outMu.Lock()
+		sigs := c.out
+		c.out = nil
+		if len(sigs) == 0 {
+			c.sending = false
+			c.outMu.Unlock()
+			return
+		}
+		c.outMu.Unlock()
+
+		for _, sig := range sigs {
+			// data signallings are stamped by their origin, so clients can
+			// order them and detect the lost ones, they are sent unnumbered
+			// without origin
+			if sig.Type == psig.SigData {
+				sig.Seq, sig.Origin = 0, seqOrigin()
+				if sig.Origin != "" {
+					sig.Seq = c.seq.Add(1)
+				} else {
+					warnNoOrigin()
+				}
+				sig.Ts = time.Now().UnixMilli()
+				sig.End = 0
+			}
+			c.realm.BroadcastToYoMo(sig)
+		}
+	}
 }
 
 // Dispatch messages to all peers in this channel of current node.
@@ -43,15 +135,33 @@ func (c *Channel) Dispatch(sig *psig.Signalling) {
 	// sig.Sid is sender's sid when sending message
 	log.Debug("[SND>]", "sid", sig.Sid, "sig", sig)
 	var sender = sig.Sid
+	// WebRTC signals are routed to their receiver only
+	var receiver string
+	if sig.Type == psig.SigControl {
+		if !c.members.observe(sig) {
+			log.Debug("[SND>] other connections of peer in channel", "cid", sig.Cid, "op", sig.OpCode, "conns", sig.Conns)
+			return
+		}
+		c.calls.observe(sig, c.hasMember)
+		if psig.IsRTC(sig.OpCode) {
+			receiver = sig.To
+		}
+	}
 	// do not broadcast APP_ID, Sid and Mesh to end user
 	sig.AppID = ""
 	sig.Sid = ""
 	sig.MeshID = ""
-	resp, err := msgpack.Marshal(sig)
-	if err != nil {
-		log.Error("msgpack marshal: %+v", err)
-		return
+	// data signallings are kept in history if enabled
+	if sig.Type == psig.SigData {
+		c.record(sig)
 	}
+	// updates to slow peers are coalesced if enabled
+	var key string
+	if c.coalesceTick() > 0 {
+		key = coalesceKey(sig)
+	}
+	// peers may negotiate different codecs, encode once per codec
+	encoded := make(map[psig.Codec][]byte, 2)
 
 	c.pdic.Range(func(k, v interface{}) bool {
 		// do not broadcast to sender-self
@@ -61,11 +171,21 @@ func (c *Channel) Dispatch(sig *psig.Signalling) {
 			// util.Log.Debug("-----------ignore sender-self", "sender", sender)
 			return true
 		}
+		if receiver != "" && p.Cid != receiver {
+			return true
+		}
 		util.Log.Debug("BroadcastPresence to ch for sid", "sender", sender, "ch", c.UniqID, "sid", p.Sid)
-		err = p.conn.Write(resp)
-		if err != nil {
-			log.Error("ws.write error", "err", err)
+		resp, ok := encoded[p.Codec]
+		if !ok {
+			var err error
+			resp, err = p.Codec.Marshal(sig)
+			if err != nil {
+				log.Error("marshal error", "codec", p.Codec.Name(), "err", err)
+				return true
+			}
+			encoded[p.Codec] = resp
 		}
+		p.deliver(resp, key)
 		return true
 	})
 }
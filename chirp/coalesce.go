@@ -0,0 +1,166 @@
+package chirp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pilarjs/prscd/psig"
+	"github.com/pilarjs/prscd/util"
+)
+
+// CoalescePolicy returns the tick of the channel coalescing high-frequency
+// updates, set by developer like PeerQuota. Updates of the same sender and
+// key within a tick are collapsed into the latest one before published to
+// the mesh, and peers too slow to receive them get the latest one only.
+// Updates are `peer_state` and `data` signallings with `k`. There is no
+// coalescing if the hook is nil or returns 0.
+var CoalescePolicy func(appID, channel string) time.Duration
+
+// coalesceTick returns the coalescing tick of the channel, 0 if disabled.
+func (c *Channel) coalesceTick() time.Duration {
+	if CoalescePolicy == nil {
+		return 0
+	}
+	return max(CoalescePolicy(c.realm.id, c.UniqID), 0)
+}
+
+// coalesceKey returns the key of update, empty if sig can not be coalesced.
+func coalesceKey(sig *psig.Signalling) string {
+	switch {
+	case sig.Type == psig.SigControl && sig.OpCode == psig.OpState:
+		return "s\x00" + sig.Cid + "\x00" + sig.Key
+	case sig.Type == psig.SigData && sig.Key != "":
+		return "d\x00" + sig.Cid + "\x00" + sig.Key
+	}
+	return ""
+}
+
+// coalescer collects the updates published within a tick.
+type coalescer struct {
+	mu        sync.Mutex
+	pending   []*psig.Signalling
+	keys      map[string]int // index in pending by key
+	scheduled bool
+}
+
+// add sig to the updates pending, replacing the one of the same key, and
+// flushes them once the tick elapses.
+func (co *coalescer) add(key string, sig *psig.Signalling, tick time.Duration, flush func(...*psig.Signalling)) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if i, ok := co.keys[key]; ok {
+		co.pending[i] = sig
+		stats.Add("coalesced_mesh", 1)
+		return
+	}
+	if co.keys == nil {
+		co.keys = make(map[string]int)
+	}
+	co.keys[key] = len(co.pending)
+	co.pending = append(co.pending, sig)
+	if !co.scheduled {
+		co.scheduled = true
+		time.AfterFunc(tick, func() {
+			if pending := co.take(); len(pending) > 0 {
+				flush(pending...)
+			}
+		})
+	}
+}
+
+// take the updates pending, in the order they are added first.
+func (co *coalescer) take() []*psig.Signalling {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	pending := co.pending
+	co.pending = nil
+	clear(co.keys)
+	co.scheduled = false
+	return pending
+}
+
+// outboxLimit returns the max messages held in the outbox of a peer, set by
+// `COALESCE_MAX_PENDING` env, default 1024.
+var outboxLimit = sync.OnceValue(func() int {
+	return max(util.GetEnvInt("COALESCE_MAX_PENDING", 1024), 1)
+})
+
+// outbox holds the messages to a peer while a message is being written, so
+// a slow peer does not hold the dispatch to others, and gets only the latest
+// update of each key. Messages over outboxLimit are dropped.
+type outbox struct {
+	mu      sync.Mutex
+	entries []*outboxEntry
+	keys    map[string]*outboxEntry // pending updates by key
+	active  bool                    // entries are being written
+}
+
+type outboxEntry struct {
+	key string
+	msg []byte
+}
+
+// deliver writes msg to this peer, updates with key are written by another
+// goroutine, and replace the pending update of the same key. Other messages
+// are written directly, unless updates are pending, to keep them in order.
+func (p *Peer) deliver(msg []byte, key string) {
+	o := &p.outbox
+	o.mu.Lock()
+	if !o.active && key == "" {
+		o.mu.Unlock()
+		if err := p.write(msg); err != nil {
+			log.Error("ws.write error", "err", err)
+		}
+		return
+	}
+	if e, ok := o.keys[key]; ok && key != "" {
+		e.msg = msg
+		o.mu.Unlock()
+		stats.Add("coalesced_local", 1)
+		return
+	}
+	if len(o.entries) >= outboxLimit() {
+		o.mu.Unlock()
+		stats.Add("outbox_dropped", 1)
+		log.Debug("peer.deliver dropped, outbox is full", "sid", p.Sid)
+		return
+	}
+	e := &outboxEntry{key: key, msg: msg}
+	o.entries = append(o.entries, e)
+	if key != "" {
+		if o.keys == nil {
+			o.keys = make(map[string]*outboxEntry)
+		}
+		o.keys[key] = e
+	}
+	if !o.active {
+		o.active = true
+		go p.drain()
+	}
+	o.mu.Unlock()
+}
+
+// drain writes the messages in outbox until it is empty.
+func (p *Peer) drain() {
+	o := &p.outbox
+	for {
+		o.mu.Lock()
+		if len(o.entries) == 0 {
+			o.active = false
+			o.mu.Unlock()
+			return
+		}
+		e := o.entries[0]
+		o.entries[0] = nil
+		o.entries = o.entries[1:]
+		if e.key != "" && o.keys[e.key] == e {
+			delete(o.keys, e.key)
+		}
+		msg := e.msg
+		o.mu.Unlock()
+
+		if err := p.write(msg); err != nil {
+			log.Error("ws.write error", "err", err)
+		}
+	}
+}
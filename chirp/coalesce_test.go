@@ -0,0 +1,178 @@
+package chirp
+
+import (
+	"bytes"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+func Test_CoalesceBroadcast(t *testing.T) {
+	defer func(fn func(string, string) time.Duration) { CoalescePolicy = fn }(CoalescePolicy)
+	CoalescePolicy = func(appID, channel string) time.Duration {
+		return 20 * time.Millisecond
+	}
+	t.Setenv("MESH_ID", "test")
+
+	sndr := &captureSender{sigs: make(chan *psig.Signalling, 10)}
+	realm := &node{id: "coalesce_app", sndr: sndr}
+	alice := realm.AddPeer(NewMockConnection("coalesce-a"), "alice")
+	alice.Join("coalesce-room")
+	send := func(sig *psig.Signalling) {
+		sig.Channel = "coalesce-room"
+		buf, _ := alice.Codec.Marshal(sig)
+		if err := alice.HandleSignal(bytes.NewReader(buf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func() *psig.Signalling {
+		select {
+		case sig := <-sndr.sigs:
+			return sig
+		case <-time.After(time.Second):
+			t.Fatal("signalling should be published")
+		}
+		return nil
+	}
+
+	// collapsed within a tick
+	for _, pl := range []string{"1", "2", "3"} {
+		send(&psig.Signalling{Type: psig.SigData, Key: "cursor", Payload: []byte(pl)})
+		send(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpState, Payload: []byte(pl)})
+	}
+	send(&psig.Signalling{Type: psig.SigData, Key: "typing", Payload: []byte("t")})
+	sig := next()
+	assert(t, sig.Key == "cursor" && string(sig.Payload) == "3" && sig.Seq == 1, "latest cursor, got %+v", sig)
+	sig = next()
+	assert(t, sig.OpCode == psig.OpState && string(sig.Payload) == "3", "latest state, got %+v", sig)
+	sig = next()
+	assert(t, sig.Key == "typing" && sig.Seq == 2, "typing is another key, got %+v", sig)
+
+	// messages not coalesced are published after the updates pending
+	send(&psig.Signalling{Type: psig.SigData, Key: "cursor", Payload: []byte("4")})
+	send(&psig.Signalling{Type: psig.SigData, Payload: []byte("msg")})
+	sig = next()
+	assert(t, sig.Key == "cursor" && string(sig.Payload) == "4", "update pending should be published first, got %+v", sig)
+	sig = next()
+	assert(t, sig.Key == "" && string(sig.Payload) == "msg", "message not coalesced, got %+v", sig)
+	select {
+	case sig := <-sndr.sigs:
+		t.Fatalf("nothing more should be published, got %+v", sig)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// slowConnection blocks writes until released.
+type slowConnection struct {
+	recordConnection
+	release chan struct{}
+}
+
+func (c *slowConnection) Write(msg []byte) error {
+	<-c.release
+	return c.recordConnection.Write(msg)
+}
+
+func Test_CoalesceSlowPeer(t *testing.T) {
+	defer func(fn func(string, string) time.Duration) { CoalescePolicy = fn }(CoalescePolicy)
+	CoalescePolicy = func(appID, channel string) time.Duration {
+		return time.Millisecond
+	}
+
+	realm := &node{id: "slow_peer_app", sndr: &MockSender{}}
+	slow := &slowConnection{recordConnection: *newRecordConnection("slow-b"), release: make(chan struct{})}
+	close(slow.release)
+	bob := realm.AddPeer(slow, "bob")
+	bob.Join("slow-room")
+	slow.release = make(chan struct{})
+	c := realm.FindChannel("slow-room")
+	update := func(pl string) {
+		c.Dispatch(&psig.Signalling{Type: psig.SigData, Channel: "slow-room", Cid: "alice", Key: "cursor", Payload: []byte(pl)})
+	}
+
+	// wait until the first update is being written
+	update("1")
+	for {
+		bob.outbox.mu.Lock()
+		writing := len(bob.outbox.entries) == 0
+		bob.outbox.mu.Unlock()
+		if writing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// dispatch is not held by the slow peer
+	done := make(chan struct{})
+	go func() {
+		for _, pl := range []string{"2", "3", "4"} {
+			update(pl)
+		}
+		c.Dispatch(&psig.Signalling{Type: psig.SigData, Channel: "slow-room", Cid: "alice", Payload: []byte("msg")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch should not be held by slow peer")
+	}
+
+	close(slow.release)
+	for slow.count() < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	slow.mu.Lock()
+	defer slow.mu.Unlock()
+	var payloads []string
+	for _, msg := range slow.msgs[1:] {
+		var sig psig.Signalling
+		if err := psig.Msgpack.Decode(bytes.NewReader(msg), &sig); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, string(sig.Payload))
+	}
+	// the first update is being written, the others collapse into the latest
+	assert(t, len(payloads) == 3 && payloads[0] == "1" && payloads[1] == "4" && payloads[2] == "msg", "slow peer should get latest update, got %v", payloads)
+}
+
+func Test_OutboxLimit(t *testing.T) {
+	defer func(fn func() int) { outboxLimit = fn }(outboxLimit)
+	outboxLimit = func() int { return 2 }
+
+	realm := &node{id: "outbox_limit_app", sndr: &MockSender{}}
+	slow := &slowConnection{recordConnection: *newRecordConnection("outbox-b"), release: make(chan struct{})}
+	bob := realm.AddPeer(slow, "bob")
+	dropped := func() int64 {
+		if v, ok := stats.Get("outbox_dropped").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := dropped()
+
+	// the update is being written, others are held up to the limit
+	bob.deliver([]byte("1"), "cursor")
+	for _, msg := range []string{"a", "b", "c"} {
+		bob.deliver([]byte(msg), "")
+	}
+	bob.outbox.mu.Lock()
+	held := len(bob.outbox.entries)
+	bob.outbox.mu.Unlock()
+	assert(t, held <= 2, "outbox should be capped, got %d", held)
+	assert(t, dropped() > before, "messages over the limit should be dropped and counted")
+
+	close(slow.release)
+	for {
+		bob.outbox.mu.Lock()
+		active := bob.outbox.active
+		bob.outbox.mu.Unlock()
+		if !active {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert(t, slow.count() == 4-int(dropped()-before), "messages held should be written, got %d", slow.count())
+}
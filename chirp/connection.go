@@ -1,14 +1,24 @@
 package chirp
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"net/http"
 	"sync"
 
+	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
 )
 
-// Connection is connection either WebSocket or WebTransport
+// ErrConnectionClosed is returned when writing to a closed connection.
+var ErrConnectionClosed = errors.New("connection closed")
+
+// Connection is connection either WebSocket, WebTransport or HTTP based fallback transports
 type Connection interface {
 	// RemoteAddr returns the client network address.
 	RemoteAddr() string
@@ -18,12 +28,34 @@ type Connection interface {
 	RawWrite(buf []byte) (int, error)
 }
 
+// Identifier is implemented by connections which can not be told apart by
+// RemoteAddr, e.g. WebTransport sessions sharing a QUIC connection.
+type Identifier interface {
+	// ID returns the unique id of the connection on this node.
+	ID() string
+}
+
 /*** WebSocket ***/
 
+// WebSocketOptions describes the options negotiated in WebSocket handshake.
+type WebSocketOptions struct {
+	// Text writes messages in Text frames instead of Binary frames, used by
+	// peers negotiated a text codec.
+	Text bool
+	// Deflate compresses messages by permessage-deflate if not nil.
+	Deflate *Deflate
+	// RemoteAddr overrides the address of conn, like the client address
+	// declared by `X-Forwarded-For` header.
+	RemoteAddr string
+}
+
 // NewWebSocketConnection creates a new WebSocketConnection
-func NewWebSocketConnection(conn net.Conn) Connection {
+func NewWebSocketConnection(conn net.Conn, opts WebSocketOptions) Connection {
 	return &WebSocketConnection{
 		underlyingConn: conn,
+		text:           opts.Text,
+		deflate:        opts.Deflate,
+		remoteAddr:     opts.RemoteAddr,
 	}
 }
 
@@ -31,10 +63,16 @@ func NewWebSocketConnection(conn net.Conn) Connection {
 type WebSocketConnection struct {
 	mu             sync.Mutex
 	underlyingConn net.Conn
+	text           bool     // write messages in Text frames instead of Binary frames
+	deflate        *Deflate // compress messages if permessage-deflate negotiated
+	remoteAddr     string   // overrides the address of underlyingConn if not empty
 }
 
 // RemoteAddr returns the client network address.
 func (c *WebSocketConnection) RemoteAddr() string {
+	if c.remoteAddr != "" {
+		return c.remoteAddr
+	}
 	return (c.underlyingConn).RemoteAddr().String()
 }
 
@@ -42,7 +80,21 @@ func (c *WebSocketConnection) RemoteAddr() string {
 func (c *WebSocketConnection) Write(msg []byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return wsutil.WriteServerBinary(c.underlyingConn, msg)
+	op := ws.OpBinary
+	if c.text {
+		op = ws.OpText
+	}
+	if c.deflate != nil && c.deflate.ShouldCompress(msg) {
+		buf, err := c.deflate.Compress(msg)
+		if err != nil {
+			return err
+		}
+		// https://www.rfc-editor.org/rfc/rfc7692#section-6, RSV1 bit indicates the message is compressed
+		frame := ws.NewFrame(op, true, buf)
+		frame.Header.Rsv = ws.Rsv(true, false, false)
+		return ws.WriteFrame(c.underlyingConn, frame)
+	}
+	return wsutil.WriteMessage(c.underlyingConn, ws.StateServerSide, op, msg)
 }
 
 // RawWrite write the raw bytes to the connection, this is a low-level implementation
@@ -54,17 +106,24 @@ func (c *WebSocketConnection) RawWrite(buf []byte) (int, error) {
 
 /*** WebTransport ***/
 
-// NewWebTransportConnection creates a new WebTransportConnection
-func NewWebTransportConnection(conn quic.Connection) Connection {
+// NewWebTransportConnection creates a new WebTransportConnection of the
+// session established by the CONNECT request on stream sessionID, a QUIC
+// connection can carry multiple sessions.
+func NewWebTransportConnection(conn quic.Connection, sessionID quic.StreamID) Connection {
 	return &WebTransportConnection{
 		underlyingConn: conn,
+		sessionID:      sessionID,
+		// https://www.rfc-editor.org/rfc/rfc9297#section-2.1
+		prefix: quicvarint.Append(nil, uint64(sessionID)/4),
 	}
 }
 
-// WebTransportConnection is a WebTransport connection
+// WebTransportConnection is a WebTransport session
 type WebTransportConnection struct {
 	mu             sync.Mutex
 	underlyingConn quic.Connection
+	sessionID      quic.StreamID
+	prefix         []byte // Quarter Stream ID of the session
 }
 
 // RemoteAddr returns the client network address.
@@ -72,13 +131,19 @@ func (c *WebTransportConnection) RemoteAddr() string {
 	return c.underlyingConn.RemoteAddr().String()
 }
 
+// ID returns the unique id of the session, which looks like `1.2.3.4:5678/4`.
+func (c *WebTransportConnection) ID() string {
+	return fmt.Sprintf("%s/%d", c.RemoteAddr(), c.sessionID)
+}
+
 // Write the data to the connection
 func (c *WebTransportConnection) Write(msg []byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// add 0x00 to msg
-	buf := []byte{0x00}
+	// prefix msg with the Quarter Stream ID of session
+	buf := make([]byte, 0, len(c.prefix)+len(msg))
+	buf = append(buf, c.prefix...)
 	buf = append(buf, msg...)
 	if err := c.underlyingConn.SendDatagram(buf); err != nil {
 		log.Error("SendMessage error", "remote", c.RemoteAddr(), "err", err)
@@ -87,6 +152,12 @@ func (c *WebTransportConnection) Write(msg []byte) error {
 	return nil
 }
 
+// MaxBatchSize implements BatchLimiter, batches fit in a datagram on common
+// paths.
+func (c *WebTransportConnection) MaxBatchSize() int {
+	return 1024
+}
+
 // RawWrite write the raw bytes to the connection, this is a low-level implementation
 func (c *WebTransportConnection) RawWrite(buf []byte) (int, error) {
 	c.mu.Lock()
@@ -98,3 +169,212 @@ func (c *WebTransportConnection) RawWrite(buf []byte) (int, error) {
 	}
 	return len(buf), nil
 }
+
+/*** Server-Sent Events ***/
+
+// NewSSEConnection creates a new SSEConnection identified by id, w must
+// implement http.Flusher.
+func NewSSEConnection(w http.ResponseWriter, id, remoteAddr string) *SSEConnection {
+	flusher, _ := w.(http.Flusher)
+	return &SSEConnection{
+		w:          w,
+		flusher:    flusher,
+		id:         id,
+		remoteAddr: remoteAddr,
+	}
+}
+
+// SSEConnection is a Server-Sent Events stream, signalling to client is sent
+// as `message` events, signalling from client is sent by HTTP POST requests.
+type SSEConnection struct {
+	mu         sync.Mutex
+	w          http.ResponseWriter
+	flusher    http.Flusher
+	id         string
+	remoteAddr string
+	closed     bool
+}
+
+// RemoteAddr returns the client network address.
+func (c *SSEConnection) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+// ID returns the id of the subscription, streams of many subscriptions may
+// be carried by the same connection.
+func (c *SSEConnection) ID() string {
+	return c.id
+}
+
+// Write the data to the connection as a `message` event.
+func (c *SSEConnection) Write(msg []byte) error {
+	return c.WriteEvent("", msg)
+}
+
+// WriteEvent writes an event with name, the default `message` event is written if name is empty.
+// https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+func (c *SSEConnection) WriteEvent(name string, data []byte) error {
+	buf := make([]byte, 0, len(data)+16)
+	if name != "" {
+		buf = append(buf, "event: "...)
+		buf = append(buf, name...)
+		buf = append(buf, '\n')
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf = append(buf, "data: "...)
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	buf = append(buf, '\n')
+	_, err := c.RawWrite(buf)
+	return err
+}
+
+// RawWrite write the raw bytes to the connection, this is a low-level implementation
+func (c *SSEConnection) RawWrite(buf []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, ErrConnectionClosed
+	}
+	n, err := c.w.Write(buf)
+	if err != nil {
+		return n, err
+	}
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+	return n, nil
+}
+
+// Close marks the stream as closed, the http.ResponseWriter must not be used
+// after the handler returns.
+func (c *SSEConnection) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+/*** HTTP Long-Polling ***/
+
+// NewLongPollConnection creates a new LongPollConnection identified by id, at
+// most maxBuffered messages are buffered between two poll requests.
+func NewLongPollConnection(id, remoteAddr string, maxBuffered int) *LongPollConnection {
+	return &LongPollConnection{
+		id:          id,
+		remoteAddr:  remoteAddr,
+		maxBuffered: maxBuffered,
+		notify:      make(chan struct{}, 1),
+	}
+}
+
+// LongPollConnection buffers signalling to client until it is acked by a
+// poll request, signalling from client is sent by HTTP POST requests. Each
+// message buffered has a cursor increased by one, starting from 1.
+type LongPollConnection struct {
+	mu          sync.Mutex
+	id          string
+	remoteAddr  string
+	queue       [][]byte
+	acked       uint64 // cursor of the last message removed from queue
+	maxBuffered int
+	dropped     int // messages dropped the client is not told yet
+	reported    int // messages dropped told by the last poll, until acked
+	notify      chan struct{}
+	closed      bool
+}
+
+// RemoteAddr returns the client network address when the session was created.
+func (c *LongPollConnection) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+// ID returns the session token, requests of many sessions may be carried by
+// the same connection.
+func (c *LongPollConnection) ID() string {
+	return c.id
+}
+
+// Write buffers the data until it is acked, the oldest message is dropped if
+// the buffer is full.
+func (c *LongPollConnection) Write(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrConnectionClosed
+	}
+	if c.maxBuffered > 0 && len(c.queue) >= c.maxBuffered {
+		c.queue = c.queue[1:]
+		c.acked++
+		c.dropped++
+	}
+	c.queue = append(c.queue, msg)
+
+	// wake up the poll request if any
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// RawWrite write the raw bytes to the connection, this is a low-level implementation
+func (c *LongPollConnection) RawWrite(buf []byte) (int, error) {
+	return len(buf), c.Write(buf)
+}
+
+// Ack removes the buffered messages up to cursor.
+func (c *LongPollConnection) Ack(cursor uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cursor <= c.acked {
+		return
+	}
+	n := min(cursor-c.acked, uint64(len(c.queue)))
+	c.queue = c.queue[n:]
+	c.acked += n
+	// the response telling the drops is received
+	c.dropped -= c.reported
+	c.reported = 0
+}
+
+// Poll waits until there are buffered messages or ctx is done, returns the
+// messages not acked yet with the cursor of the last one, and the number of
+// messages dropped because of buffer overflow since last ack. The messages
+// and the number of dropped are kept until they are acked.
+func (c *LongPollConnection) Poll(ctx context.Context) (msgs [][]byte, cursor uint64, dropped int, err error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, 0, 0, ErrConnectionClosed
+		}
+		if len(c.queue) > 0 {
+			msgs, dropped = append([][]byte(nil), c.queue...), c.dropped
+			cursor = c.acked + uint64(len(c.queue))
+			c.reported = c.dropped
+			c.mu.Unlock()
+			return msgs, cursor, dropped, nil
+		}
+		cursor = c.acked
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, cursor, 0, nil
+		case <-c.notify:
+		}
+	}
+}
+
+// Close drops buffered messages, the following writes fail.
+func (c *LongPollConnection) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.queue = nil
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
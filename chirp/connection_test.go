@@ -0,0 +1,96 @@
+package chirp
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_LongPollConnection(t *testing.T) {
+	conn := NewLongPollConnection("session-1", "127.0.0.1:1234", 2)
+
+	// poll returns nothing when timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	msgs, cursor, dropped, err := conn.Poll(ctx)
+	cancel()
+	assert(t, err == nil, "poll error: %v", err)
+	assert(t, len(msgs) == 0 && dropped == 0 && cursor == 0, "should get nothing, but got %d msgs, %d dropped, cursor %d", len(msgs), dropped, cursor)
+
+	// the oldest message is dropped when buffer is full
+	for _, msg := range []string{"a", "b", "c"} {
+		assert(t, conn.Write([]byte(msg)) == nil, "write should succeed")
+	}
+	msgs, cursor, dropped, err = conn.Poll(context.Background())
+	assert(t, err == nil, "poll error: %v", err)
+	assert(t, len(msgs) == 2 && string(msgs[0]) == "b" && string(msgs[1]) == "c", "should get [b c], but got %q", msgs)
+	assert(t, dropped == 1 && cursor == 3, "should drop 1 message with cursor 3, but got %d, %d", dropped, cursor)
+
+	// messages and drops are kept until acked
+	msgs, _, dropped, _ = conn.Poll(context.Background())
+	assert(t, len(msgs) == 2 && dropped == 1, "messages not acked should be polled again, but got %q, %d dropped", msgs, dropped)
+	conn.Ack(2)
+	msgs, cursor, dropped, _ = conn.Poll(context.Background())
+	assert(t, len(msgs) == 1 && string(msgs[0]) == "c" && cursor == 3, "should get [c] after ack 2, but got %q, cursor %d", msgs, cursor)
+	assert(t, dropped == 0, "drops told should be cleared by ack, but got %d", dropped)
+	conn.Ack(cursor)
+
+	// poll in flight is woken up by write
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.Write([]byte("d"))
+	}()
+	msgs, cursor, _, _ = conn.Poll(context.Background())
+	assert(t, len(msgs) == 1 && string(msgs[0]) == "d" && cursor == 4, "should get [d] with cursor 4, but got %q, %d", msgs, cursor)
+	conn.Ack(cursor)
+
+	// poll in flight is woken up by close
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.Close()
+	}()
+	_, _, _, err = conn.Poll(context.Background())
+	assert(t, err == ErrConnectionClosed, "should be ErrConnectionClosed, but got %v", err)
+	assert(t, conn.Write([]byte("e")) == ErrConnectionClosed, "write after close should fail")
+}
+
+func Test_SessionsSharingRemoteAddr(t *testing.T) {
+	realm := &node{id: "shared_addr_app", sndr: &MockSender{}}
+	first := realm.AddPeer(NewLongPollConnection("session-1", "127.0.0.1:1234", 10), "alice")
+	first.Join("shared-room")
+	second := realm.AddPeer(NewLongPollConnection("session-2", "127.0.0.1:1234", 10), "alice")
+	second.Join("shared-room")
+	assert(t, first.Sid != second.Sid, "sessions should be told apart, both got %q", first.Sid)
+
+	// the first session expires
+	first.Disconnect()
+	_, ok := realm.pdic.Load(second.Sid)
+	assert(t, ok, "second session should be kept on node")
+	assert(t, realm.FindChannel("shared-room").hasPeer(second), "second session should be kept in channel")
+	assert(t, len(realm.PeersByCid("alice")) == 1, "second session should be indexed by cid, got %d", len(realm.PeersByCid("alice")))
+
+	// a peer replaced by the same sid does not remove the new one
+	replaced := realm.AddPeer(NewLongPollConnection("session-2", "127.0.0.1:1234", 10), "alice")
+	replaced.Join("shared-room")
+	second.Disconnect()
+	assert(t, realm.FindChannel("shared-room").hasPeer(replaced), "peer replacing should be kept in channel")
+	v, ok := realm.pdic.Load(replaced.Sid)
+	assert(t, ok && v.(*Peer) == replaced, "peer replacing should be kept on node")
+}
+
+func Test_SSEStreamsSharingRemoteAddr(t *testing.T) {
+	realm := &node{id: "shared_sse_app", sndr: &MockSender{}}
+	first := realm.AddPeer(NewSSEConnection(httptest.NewRecorder(), "sub-1", "127.0.0.1:1234"), "alice")
+	first.Join("sse-room")
+	secondConn := httptest.NewRecorder()
+	second := realm.AddPeer(NewSSEConnection(secondConn, "sub-2", "127.0.0.1:1234"), "bob")
+	second.Join("sse-room")
+
+	// the first stream unsubscribes
+	first.Disconnect()
+	_, ok := realm.pdic.Load(second.Sid)
+	assert(t, ok && realm.FindChannel("sse-room").hasPeer(second), "second stream should be kept")
+	second.conn.Write([]byte("hi"))
+	assert(t, strings.Contains(secondConn.Body.String(), "data: hi"), "second stream should be written, got %q", secondConn.Body)
+}
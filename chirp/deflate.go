@@ -0,0 +1,156 @@
+package chirp
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"expvar"
+	"io"
+
+	"github.com/gobwas/ws/wsflate"
+)
+
+// deflateStats describes the traffic of permessage-deflate WebSocket
+// connections, the ratio is compressed bytes divided by raw bytes.
+var deflateStats = expvar.NewMap("ws_deflate")
+
+func init() {
+	deflateStats.Set("out_ratio", expvar.Func(func() any {
+		return ratio(deflateStats.Get("out_compressed_bytes"), deflateStats.Get("out_raw_bytes"))
+	}))
+	deflateStats.Set("in_ratio", expvar.Func(func() any {
+		return ratio(deflateStats.Get("in_compressed_bytes"), deflateStats.Get("in_raw_bytes"))
+	}))
+}
+
+func ratio(compressed, raw expvar.Var) float64 {
+	c, ok1 := compressed.(*expvar.Int)
+	r, ok2 := raw.(*expvar.Int)
+	if !ok1 || !ok2 || r.Value() == 0 {
+		return 0
+	}
+	return float64(c.Value()) / float64(r.Value())
+}
+
+// deflateWindowSize is the LZ77 window size of compress/flate, which means
+// only `max_window_bits=15` is supported.
+const deflateWindowSize = 1 << 15
+
+// deflateTail is appended to compressed message before decompressing,
+// https://www.rfc-editor.org/rfc/rfc7692#section-7.2.2, followed by an
+// empty final stored block to let flate reader stop without io.ErrUnexpectedEOF.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// ErrDeflateMessageTooLarge is returned when the decompressed message exceeds DeflateOptions.MaxMessageSize.
+var ErrDeflateMessageTooLarge = errors.New("decompressed message too large")
+
+// DeflateOptions describes the permessage-deflate settings, https://www.rfc-editor.org/rfc/rfc7692.
+type DeflateOptions struct {
+	// Threshold is the minimal size of message to be compressed, smaller messages are sent uncompressed.
+	Threshold int
+	// Level is the compression level of compress/flate.
+	Level int
+	// ServerNoContextTakeover resets the compressor after each message.
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover asks client to reset its compressor after each message.
+	ClientNoContextTakeover bool
+	// MaxMessageSize limits the size of decompressed message from client.
+	MaxMessageSize int64
+}
+
+// Deflate compresses and decompresses messages of one WebSocket connection
+// with the parameters negotiated in handshake.
+type Deflate struct {
+	opts   DeflateOptions
+	params wsflate.Parameters
+
+	// compress
+	fw   *flate.Writer
+	wbuf bytes.Buffer
+
+	// decompress
+	fr   io.ReadCloser
+	dict []byte
+}
+
+// NewDeflate creates a Deflate with negotiated params.
+func NewDeflate(params wsflate.Parameters, opts DeflateOptions) *Deflate {
+	return &Deflate{
+		opts:   opts,
+		params: params,
+	}
+}
+
+// ShouldCompress reports whether msg is large enough to be compressed.
+func (d *Deflate) ShouldCompress(msg []byte) bool {
+	return len(msg) >= d.opts.Threshold
+}
+
+// Compress msg, the returned bytes are only valid until next call.
+func (d *Deflate) Compress(msg []byte) ([]byte, error) {
+	d.wbuf.Reset()
+	if d.fw == nil {
+		fw, err := flate.NewWriter(&d.wbuf, d.opts.Level)
+		if err != nil {
+			return nil, err
+		}
+		d.fw = fw
+	}
+	if _, err := d.fw.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := d.fw.Flush(); err != nil {
+		return nil, err
+	}
+	if d.params.ServerNoContextTakeover {
+		d.fw.Reset(&d.wbuf)
+	}
+
+	// remove the 0x00 0x00 0xff 0xff tail of sync flush
+	buf := d.wbuf.Bytes()
+	buf = buf[:len(buf)-4]
+
+	deflateStats.Add("out_raw_bytes", int64(len(msg)))
+	deflateStats.Add("out_compressed_bytes", int64(len(buf)))
+	return buf, nil
+}
+
+// MaxMessageSize returns the max size of message from client, compressed or
+// decompressed, 1MB if not set.
+func (d *Deflate) MaxMessageSize() int64 {
+	if d.opts.MaxMessageSize <= 0 {
+		return 1 << 20
+	}
+	return d.opts.MaxMessageSize
+}
+
+// Decompress a message sent by client with RSV1 bit set.
+func (d *Deflate) Decompress(msg []byte) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(msg), bytes.NewReader(deflateTail))
+	if d.fr == nil {
+		d.fr = flate.NewReaderDict(src, d.dict)
+	} else if err := d.fr.(flate.Resetter).Reset(src, d.dict); err != nil {
+		return nil, err
+	}
+
+	limit := d.MaxMessageSize()
+	buf, err := io.ReadAll(io.LimitReader(d.fr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > limit {
+		return nil, ErrDeflateMessageTooLarge
+	}
+
+	// with context takeover, the next message may reference the last 32KB of data
+	if !d.params.ClientNoContextTakeover {
+		d.dict = append(d.dict, buf...)
+		if len(d.dict) > deflateWindowSize {
+			d.dict = append(d.dict[:0], d.dict[len(d.dict)-deflateWindowSize:]...)
+		}
+	}
+
+	deflateStats.Add("in_raw_bytes", int64(len(buf)))
+	deflateStats.Add("in_compressed_bytes", int64(len(msg)))
+	return buf, nil
+}
@@ -0,0 +1,48 @@
+package chirp
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+
+	"github.com/gobwas/ws/wsflate"
+)
+
+func Test_Deflate(t *testing.T) {
+	opts := DeflateOptions{Threshold: 16, Level: flate.BestSpeed, MaxMessageSize: 1 << 10}
+	msgs := [][]byte{
+		bytes.Repeat([]byte(`{"cursor":{"x":1,"y":2}}`), 8),
+		bytes.Repeat([]byte(`{"cursor":{"x":1,"y":2}}`), 8),
+		[]byte(`{"typing":"hello world, hello world"}`),
+	}
+
+	for _, params := range []wsflate.Parameters{
+		{},
+		{ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+	} {
+		// server compresses, and the other side decompresses with the same parameters
+		sender := NewDeflate(params, opts)
+		receiver := NewDeflate(wsflate.Parameters{ClientNoContextTakeover: params.ServerNoContextTakeover}, opts)
+		for i, msg := range msgs {
+			assert(t, sender.ShouldCompress(msg), "msg %d should be compressed", i)
+			compressed, err := sender.Compress(msg)
+			assert(t, err == nil, "compress error: %v", err)
+			// copy, compressed bytes are reused by next call
+			compressed = append([]byte(nil), compressed...)
+			got, err := receiver.Decompress(compressed)
+			assert(t, err == nil, "decompress error: %v", err)
+			assert(t, bytes.Equal(got, msg), "msg %d should be %s, but got %s", i, msg, got)
+		}
+	}
+
+	// decompressed message exceeds max size
+	sender := NewDeflate(wsflate.Parameters{}, opts)
+	receiver := NewDeflate(wsflate.Parameters{}, opts)
+	compressed, _ := sender.Compress(bytes.Repeat([]byte("a"), 2<<10))
+	_, err := receiver.Decompress(compressed)
+	assert(t, err == ErrDeflateMessageTooLarge, "should be ErrDeflateMessageTooLarge, but got %v", err)
+	assert(t, receiver.MaxMessageSize() == 1<<10, "max message size should be set, but got %d", receiver.MaxMessageSize())
+	assert(t, NewDeflate(wsflate.Parameters{}, DeflateOptions{}).MaxMessageSize() == 1<<20, "max message size should be 1MB by default")
+
+	assert(t, !sender.ShouldCompress([]byte("short")), "short message should not be compressed")
+}
@@ -0,0 +1,88 @@
+package chirp
+
+import (
+	"errors"
+	"os"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+var (
+	// ErrNoReceiver is returned when a direct or WebRTC signal does not declare its receiver.
+	ErrNoReceiver = errors.New("signal must declare the client id of receiver")
+	// ErrChannelNotJoined is returned when a signal is scoped to a channel the sender has not joined.
+	ErrChannelNotJoined = errors.New("channel not joined")
+)
+
+// SendDirect sends the direct signal to the peers of client id `sig.To` on
+// all nodes over the mesh. If `sig.Channel` is set, only the peers in that
+// channel receive it, and this peer must have joined it.
+func (p *Peer) SendDirect(sig *psig.Signalling) error {
+	if sig.To == "" {
+		log.Error("peer.send_direct error", "sid", p.Sid, "err", ErrNoReceiver)
+		return ErrNoReceiver
+	}
+	if sig.Channel != "" {
+		p.mu.Lock()
+		_, joined := p.Channels[sig.Channel]
+		p.mu.Unlock()
+		if !joined {
+			log.Error("peer.send_direct error", "sid", p.Sid, "channel", sig.Channel, "err", ErrChannelNotJoined)
+			return ErrChannelNotJoined
+		}
+	}
+	sig.Cid = p.Cid
+	p.realm.BroadcastDirect(sig)
+	return nil
+}
+
+// BroadcastDirect sends the direct signal over the mesh, it is delivered by
+// the nodes which the receiver connects to.
+func (n *node) BroadcastDirect(sig *psig.Signalling) {
+	sigSentOverYoMo := sig.Clone()
+	sigSentOverYoMo.AppID = n.id
+	sigSentOverYoMo.MeshID = os.Getenv("MESH_ID")
+	go n.BroadcastToYoMo(&sigSentOverYoMo)
+}
+
+// DispatchDirect delivers the direct signal to the peers of receiver on this
+// node, other than the connection sent it.
+func (n *node) DispatchDirect(sig *psig.Signalling) {
+	var sender = sig.Sid
+	// do not send APP_ID, Sid and Mesh to end user
+	sig.AppID = ""
+	sig.Sid = ""
+	sig.MeshID = ""
+	// scoped to the channel if set
+	var channel *Channel
+	if sig.Channel != "" {
+		if channel = n.FindChannel(sig.Channel); channel == nil {
+			return
+		}
+	}
+	// peers may negotiate different codecs, encode once per codec
+	encoded := make(map[psig.Codec][]byte, 2)
+
+	for _, p := range n.PeersByCid(sig.To) {
+		if p.Sid == sender {
+			continue
+		}
+		if channel != nil && !channel.hasPeer(p) {
+			continue
+		}
+		resp, ok := encoded[p.Codec]
+		if !ok {
+			var err error
+			resp, err = p.Codec.Marshal(sig)
+			if err != nil {
+				log.Error("marshal error", "codec", p.Codec.Name(), "err", err)
+				continue
+			}
+			encoded[p.Codec] = resp
+		}
+		if err := p.write(resp); err != nil {
+			log.Error("direct.write error", "sid", p.Sid, "err", err)
+		}
+		log.Debug("[SND>] direct", "sid", p.Sid, "from", sig.Cid, "to", sig.To)
+	}
+}
@@ -0,0 +1,131 @@
+package chirp
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+// recordConnection records the messages written to it.
+type recordConnection struct {
+	MockConnection
+	mu   sync.Mutex
+	msgs [][]byte
+}
+
+func newRecordConnection(sid string) *recordConnection {
+	return &recordConnection{MockConnection: MockConnection{sid: sid}}
+}
+
+func (c *recordConnection) Write(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+func (c *recordConnection) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.msgs)
+}
+
+func Test_PeersByCid(t *testing.T) {
+	realm := &node{id: "cid_app", sndr: &MockSender{}}
+	realm.AddPeer(NewMockConnection("cid-1"), "bob")
+	realm.AddPeer(NewMockConnection("cid-2"), "bob")
+	carol := realm.AddPeer(NewMockConnection("cid-3"), "carol")
+	assert(t, len(realm.PeersByCid("bob")) == 2, "bob connects twice, got %d", len(realm.PeersByCid("bob")))
+
+	// the same sid replaces the peer
+	realm.AddPeer(NewMockConnection("cid-2"), "dave")
+	assert(t, len(realm.PeersByCid("bob")) == 1, "replaced peer should be unindexed, got %d", len(realm.PeersByCid("bob")))
+
+	assert(t, realm.setCid(carol, "erin") == nil, "cid can be set")
+	assert(t, len(realm.PeersByCid("carol")) == 0 && len(realm.PeersByCid("erin")) == 1, "peer should be indexed by new cid")
+
+	realm.RemovePeer("cid-1")
+	realm.RemovePeer("cid-2")
+	realm.RemovePeer("cid-3")
+	assert(t, len(realm.cids) == 0, "index should be empty, got %v", realm.cids)
+}
+
+func Test_CidChange(t *testing.T) {
+	realm := &node{id: "cid_change_app", sndr: &MockSender{}}
+	aliceConn, tabConn := newRecordConnection("cid-change-a"), newRecordConnection("cid-change-t")
+	realm.AddPeer(aliceConn, "alice")
+	tab := realm.AddPeer(tabConn, "guest")
+	gateway := realm.AddPeer(NewMockConnection("cid-change-g"), "gateway")
+	gateway.CidVerified = true
+	tab.Join("cid-change-room")
+
+	// the second tab of a user takes its client id by `peer_state`
+	buf, _ := tab.Codec.Marshal(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpState, Channel: "cid-change-room", Cid: "alice"})
+	if err := tab.HandleSignal(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, tab.Cid == "alice" && len(realm.PeersByCid("alice")) == 2, "cid should be taken by the second tab, got %s", tab.Cid)
+
+	aliceConn.msgs, tabConn.msgs = nil, nil
+	realm.DispatchDirect(&psig.Signalling{Type: psig.SigDirect, Cid: "bob", To: "alice", Payload: []byte("hi")})
+	assert(t, aliceConn.count() == 1 && tabConn.count() == 1, "direct signal should be delivered to both tabs")
+
+	// client id verified by certificate can not be changed
+	err := realm.setCid(gateway, "erin")
+	assert(t, errors.Is(err, ErrCidVerified) && gateway.Cid == "gateway", "verified cid should not be changed, got %v", err)
+}
+
+func Test_DispatchDirect(t *testing.T) {
+	realm := &node{id: "direct_app", sndr: &MockSender{}}
+	alice := realm.AddPeer(newRecordConnection("direct-a"), "alice")
+	bob1Conn, bob2Conn, carolConn := newRecordConnection("direct-b1"), newRecordConnection("direct-b2"), newRecordConnection("direct-c")
+	bob1 := realm.AddPeer(bob1Conn, "bob")
+	realm.AddPeer(bob2Conn, "bob")
+	realm.AddPeer(carolConn, "carol")
+	alice.Join("direct-room")
+	bob1.Join("direct-room")
+	for _, c := range []*recordConnection{bob1Conn, bob2Conn, carolConn} {
+		c.msgs = nil
+	}
+
+	// delivered to all connections of receiver only
+	realm.DispatchDirect(&psig.Signalling{Type: psig.SigDirect, Sid: alice.Sid, Cid: "alice", To: "bob", Payload: []byte("hi")})
+	assert(t, bob1Conn.count() == 1 && bob2Conn.count() == 1, "bob should receive on both connections")
+	assert(t, carolConn.count() == 0, "carol should not receive")
+
+	var sig psig.Signalling
+	if err := psig.Msgpack.Decode(bytes.NewReader(bob1Conn.msgs[0]), &sig); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, sig.Cid == "alice" && sig.Sid == "" && string(sig.Payload) == "hi", "signal received, got %+v", sig)
+
+	// scoped to channel, only the connection joined it receives
+	realm.DispatchDirect(&psig.Signalling{Type: psig.SigDirect, Sid: alice.Sid, Cid: "alice", To: "bob", Channel: "direct-room"})
+	assert(t, bob1Conn.count() == 2 && bob2Conn.count() == 1, "only bob in channel should receive")
+
+	// not echoed to the connection sent it
+	realm.DispatchDirect(&psig.Signalling{Type: psig.SigDirect, Sid: bob1.Sid, Cid: "bob", To: "bob"})
+	assert(t, bob1Conn.count() == 2 && bob2Conn.count() == 2, "should not echo to sender connection")
+}
+
+func Test_SendDirect(t *testing.T) {
+	sndr := &captureSender{sigs: make(chan *psig.Signalling, 1)}
+	realm := &node{id: "send_direct_app", sndr: sndr}
+	alice := realm.AddPeer(NewMockConnection("send-direct-a"), "alice")
+
+	err := alice.SendDirect(&psig.Signalling{Type: psig.SigDirect})
+	assert(t, errors.Is(err, ErrNoReceiver), "receiver is required, got %v", err)
+	err = alice.SendDirect(&psig.Signalling{Type: psig.SigDirect, To: "bob", Channel: "not-joined"})
+	assert(t, errors.Is(err, ErrChannelNotJoined), "channel should be joined, got %v", err)
+
+	buf, _ := alice.Codec.Marshal(&psig.Signalling{Type: psig.SigDirect, To: "bob", Cid: "mallory"})
+	if err := alice.HandleSignal(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+	sig := <-sndr.sigs
+	assert(t, sig.Type == psig.SigDirect && sig.To == "bob", "direct signal should be sent over mesh, got %+v", sig)
+	assert(t, sig.Cid == "alice" && sig.AppID == "send_direct_app", "sender should be set by server, got %+v", sig)
+}
@@ -0,0 +1,121 @@
+package chirp
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pilarjs/prscd/psig"
+	"github.com/pilarjs/prscd/util"
+)
+
+// heartbeatConfig describes how often nodes tell others they are alive, and
+// how long a node is silent before considered gone.
+type heartbeatConfig struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// meshHeartbeat returns the heartbeat of nodes, set by env
+// `MESH_HEARTBEAT_INTERVAL` (default 10s, 0 disables it) and
+// `MESH_NODE_TIMEOUT` (default 30s).
+var meshHeartbeat = sync.OnceValue(func() heartbeatConfig {
+	return heartbeatConfig{
+		interval: max(util.GetEnvDuration("MESH_HEARTBEAT_INTERVAL", 10*time.Second), 0),
+		timeout:  max(util.GetEnvDuration("MESH_NODE_TIMEOUT", 30*time.Second), 0),
+	}
+})
+
+// meshNodes tracks the other nodes of the realm by their heartbeats, nodes
+// never sending one, like those of older versions, are not tracked.
+type meshNodes struct {
+	mu   sync.Mutex
+	seen map[string]meshNode // by mesh id
+}
+
+type meshNode struct {
+	boot string    // origin of the node, changed on restart
+	at   time.Time // when the last heartbeat was received
+}
+
+// heartbeat tells other nodes this node is alive, and drops the members on
+// nodes gone, until the process exits.
+func (n *node) heartbeat() {
+	cfg := meshHeartbeat()
+	if cfg.interval == 0 {
+		return
+	}
+	n.sendHeartbeat()
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n.sendHeartbeat()
+		if cfg.timeout > 0 {
+			n.expireNodes(time.Now().Add(-cfg.timeout))
+		}
+	}
+}
+
+func (n *node) sendHeartbeat() {
+	n.BroadcastToYoMo(&psig.Signalling{
+		Type:   psig.SigControl,
+		OpCode: psig.OpNodeAlive,
+		AppID:  n.id,
+		MeshID: os.Getenv("MESH_ID"),
+		Origin: seqOrigin(),
+	})
+}
+
+// nodeAlive records the heartbeat of node meshID booted as boot, the
+// members on its previous boot are dropped if it restarted.
+func (n *node) nodeAlive(meshID, boot string) {
+	if meshID == "" || meshID == os.Getenv("MESH_ID") {
+		return
+	}
+	n.nodes.mu.Lock()
+	if n.nodes.seen == nil {
+		n.nodes.seen = make(map[string]meshNode)
+	}
+	prev, ok := n.nodes.seen[meshID]
+	n.nodes.seen[meshID] = meshNode{boot: boot, at: time.Now()}
+	n.nodes.mu.Unlock()
+	if ok && prev.boot != boot {
+		log.Info("node.restarted", "meshID", meshID, "boot", boot)
+		n.dropNode(meshID)
+	}
+}
+
+// expireNodes drops the members on nodes without heartbeat since deadline.
+func (n *node) expireNodes(deadline time.Time) {
+	var gone []string
+	n.nodes.mu.Lock()
+	for meshID, node := range n.nodes.seen {
+		if node.at.Before(deadline) {
+			delete(n.nodes.seen, meshID)
+			gone = append(gone, meshID)
+		}
+	}
+	n.nodes.mu.Unlock()
+	for _, meshID := range gone {
+		log.Info("node.gone", "meshID", meshID)
+		n.dropNode(meshID)
+	}
+}
+
+// dropNode announces the members on the node of meshID offline, to the
+// peers on this node, as if they left.
+func (n *node) dropNode(meshID string) {
+	n.cdic.Range(func(_, v any) bool {
+		c := v.(*Channel)
+		for _, cid := range c.members.cidsOn(meshID) {
+			c.Dispatch(&psig.Signalling{
+				Type:    psig.SigControl,
+				OpCode:  psig.OpPeerOffline,
+				Channel: c.UniqID,
+				Cid:     cid,
+				MeshID:  meshID,
+			})
+		}
+		return true
+	})
+}
@@ -0,0 +1,257 @@
+package chirp
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pilarjs/prscd/psig"
+	"github.com/pilarjs/prscd/util"
+)
+
+// HistoryPolicy returns how many data signallings of the channel are kept in
+// history, at most `size` messages not older than `ttl`, set by developer
+// like PeerQuota. There is no history if the hook is nil or `size` is 0, and
+// no age limit if `ttl` is 0.
+var HistoryPolicy func(appID, channel string) (size int, ttl time.Duration)
+
+// HistoryStore keeps the history of channels, it is safe for concurrent use.
+type HistoryStore interface {
+	// Append adds sig to the history of key, and evicts the messages beyond
+	// size or ttl.
+	Append(key string, sig *psig.Signalling, size int, ttl time.Duration) error
+	// Query returns the messages of key matching q, oldest first.
+	Query(key string, q HistoryQuery) ([]*psig.Signalling, error)
+}
+
+// HistoryQuery describes the messages requested from history.
+type HistoryQuery struct {
+	Ts     int64  // published not earlier than it, in unix milliseconds
+	Origin string // published on this origin only, if set
+	After  uint64 // sequence numbers of Origin after it
+	Until  uint64 // sequence numbers of Origin up to it, 0 means no limit
+}
+
+// match tells if sig matches the query.
+func (q HistoryQuery) match(sig *psig.Signalling) bool {
+	if sig.Ts < q.Ts {
+		return false
+	}
+	if q.Origin == "" {
+		return true
+	}
+	return sig.Origin == q.Origin && sig.Seq > q.After && (q.Until == 0 || sig.Seq <= q.Until)
+}
+
+// History is the store of channel history, if it is nil when the first
+// message is recorded, a store is created by `HISTORY_STORE` env: `memory`
+// by default, or `file` to persist history in `HISTORY_DIR`, keeping at most
+// `HISTORY_MAX_OPEN_FILES` (default 256) files open. The history of
+// channels idle for `HISTORY_IDLE_TIMEOUT` (default 1h) is dropped from
+// memory.
+var History HistoryStore
+
+var historyStore = sync.OnceValue(func() HistoryStore {
+	if History != nil {
+		return History
+	}
+	idle := max(util.GetEnvDuration("HISTORY_IDLE_TIMEOUT", time.Hour), 0)
+	if os.Getenv("HISTORY_STORE") == "file" {
+		dir := os.Getenv("HISTORY_DIR")
+		if dir == "" {
+			dir = "./history"
+		}
+		store, err := NewFileHistory(dir, idle, max(util.GetEnvInt("HISTORY_MAX_OPEN_FILES", 256), 0))
+		if err == nil {
+			log.Info("history store", "dir", dir)
+			return store
+		}
+		log.Error("history store fallback to memory", "dir", dir, "err", err)
+	}
+	return NewMemoryHistory(idle)
+})
+
+// historyPolicy returns the history policy of the channel, size is 0 if
+// disabled.
+func (c *Channel) historyPolicy() (int, time.Duration) {
+	if HistoryPolicy == nil {
+		return 0, 0
+	}
+	size, ttl := HistoryPolicy(c.realm.id, c.UniqID)
+	return max(size, 0), max(ttl, 0)
+}
+
+// historyKey returns the key of channel history, channels of different apps
+// are separated.
+func (c *Channel) historyKey() string {
+	return c.realm.id + "/" + c.UniqID
+}
+
+// record adds the data signalling dispatched to the history of channel.
+func (c *Channel) record(sig *psig.Signalling) {
+	size, ttl := c.historyPolicy()
+	if size == 0 {
+		return
+	}
+	// not stamped by nodes of older versions or backend sfn
+	if sig.Ts == 0 {
+		sig.Ts = time.Now().UnixMilli()
+	}
+	if err := historyStore().Append(c.historyKey(), sig, size, ttl); err != nil {
+		log.Error("history.append error", "channel", c.UniqID, "err", err)
+	}
+}
+
+// replayHistory sends the messages of the channel requested by req to this
+// peer, then echoes req to tell the end of replay. Messages dispatched
+// during the replay may be received twice, clients should skip them by `o`
+// and `seq`.
+func (p *Peer) replayHistory(c *Channel, req *psig.Signalling) error {
+	if size, ttl := c.historyPolicy(); size > 0 {
+		q := HistoryQuery{Ts: req.Ts, Origin: req.Origin, After: req.Seq, Until: req.End}
+		if ttl > 0 {
+			q.Ts = max(q.Ts, time.Now().Add(-ttl).UnixMilli())
+		}
+		sigs, err := historyStore().Query(c.historyKey(), q)
+		if err != nil {
+			log.Error("history.since error", "sid", p.Sid, "channel", c.UniqID, "err", err)
+			return err
+		}
+		// stores may keep more, like the file store reloaded after restart
+		sigs = sigs[max(len(sigs)-size, 0):]
+		for _, sig := range sigs {
+			p.NotifyBack(sig)
+		}
+	}
+	p.NotifyBack(&psig.Signalling{
+		Type:    psig.SigControl,
+		OpCode:  psig.OpHistory,
+		Channel: c.UniqID,
+		Seq:     req.Seq,
+		Origin:  req.Origin,
+		Ts:      req.Ts,
+		End:     req.End,
+	})
+	return nil
+}
+
+// NewMemoryHistory creates a HistoryStore keeping messages in memory, by a
+// ring buffer per channel. The history of channels neither appended nor
+// queried for idle is dropped, 0 means never.
+func NewMemoryHistory(idle time.Duration) HistoryStore {
+	return &memoryHistory{logs: make(map[string]*historyLog), idle: idle}
+}
+
+type memoryHistory struct {
+	mu    sync.Mutex
+	logs  map[string]*historyLog
+	idle  time.Duration
+	swept time.Time // when idle logs were dropped last
+}
+
+// historyLog is the history of a channel.
+type historyLog struct {
+	entries []*psig.Signalling // ring buffer
+	head    int                // index of the oldest message
+	n       int                // number of messages
+	used    time.Time          // when it was appended or queried last
+}
+
+func (m *memoryHistory) Append(key string, sig *psig.Signalling, size int, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.sweepLocked(now)
+	l := m.logs[key]
+	if l == nil {
+		l = &historyLog{}
+		m.logs[key] = l
+	}
+	l.used = now
+	entry := sig.Clone()
+	l.push(&entry, size)
+	if ttl > 0 {
+		l.evictBefore(time.Now().Add(-ttl).UnixMilli())
+	}
+	return nil
+}
+
+func (m *memoryHistory) Query(key string, q HistoryQuery) ([]*psig.Signalling, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.logs[key]
+	if l == nil {
+		return nil, nil
+	}
+	l.used = time.Now()
+	return l.query(q), nil
+}
+
+// sweepLocked drops the logs idle, at most once per half of idle.
+func (m *memoryHistory) sweepLocked(now time.Time) {
+	if m.idle == 0 || now.Sub(m.swept) < m.idle/2 {
+		return
+	}
+	m.swept = now
+	for key, l := range m.logs {
+		if now.Sub(l.used) > m.idle {
+			delete(m.logs, key)
+		}
+	}
+}
+
+// drop the log of key.
+func (m *memoryHistory) drop(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.logs, key)
+}
+
+// push adds the message, the oldest one is dropped if there are size
+// messages already. The buffer is resized if size changes.
+func (l *historyLog) push(sig *psig.Signalling, size int) {
+	if len(l.entries) != size {
+		entries := l.all()
+		if len(entries) > size-1 {
+			entries = entries[len(entries)-(size-1):]
+		}
+		l.entries = make([]*psig.Signalling, size)
+		l.head, l.n = 0, copy(l.entries, entries)
+	}
+	if l.n == size {
+		l.entries[l.head] = sig
+		l.head = (l.head + 1) % size
+		return
+	}
+	l.entries[(l.head+l.n)%size] = sig
+	l.n++
+}
+
+// evictBefore drops the messages recorded before ts.
+func (l *historyLog) evictBefore(ts int64) {
+	for l.n > 0 && l.entries[l.head].Ts < ts {
+		l.entries[l.head] = nil
+		l.head = (l.head + 1) % len(l.entries)
+		l.n--
+	}
+}
+
+// all returns the messages, oldest first.
+func (l *historyLog) all() []*psig.Signalling {
+	entries := make([]*psig.Signalling, 0, l.n)
+	for i := range l.n {
+		entries = append(entries, l.entries[(l.head+i)%len(l.entries)])
+	}
+	return entries
+}
+
+func (l *historyLog) query(q HistoryQuery) []*psig.Signalling {
+	var sigs []*psig.Signalling
+	for _, entry := range l.all() {
+		if q.match(entry) {
+			sig := entry.Clone()
+			sigs = append(sigs, &sig)
+		}
+	}
+	return sigs
+}
@@ -0,0 +1,280 @@
+package chirp
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+// NewFileHistory creates a HistoryStore persisting messages in dir, a file
+// per channel, so history survives restarts. Messages are served from
+// memory, the file of a channel is loaded when the channel is accessed
+// first, kept open for appending, and is compacted when it holds twice the
+// messages kept. Channels idle for idle are unloaded, 0 means never. At most
+// maxOpen files are kept open, the least recently appended are closed
+// first, 0 means no limit.
+func NewFileHistory(dir string, idle time.Duration, maxOpen int) (HistoryStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileHistory{
+		dir:     dir,
+		idle:    idle,
+		maxOpen: maxOpen,
+		mem:     &memoryHistory{logs: make(map[string]*historyLog)},
+		files:   make(map[string]*historyFile),
+		lru:     list.New(),
+	}, nil
+}
+
+type fileHistory struct {
+	dir     string
+	idle    time.Duration
+	maxOpen int
+	mem     *memoryHistory
+	mu      sync.Mutex              // guards files, lru and swept
+	files   map[string]*historyFile // loaded channels
+	lru     *list.List              // files open, the most recently appended first
+	swept   time.Time               // when idle channels were unloaded last
+}
+
+// historyFile is the file of a loaded channel, appends and queries of the
+// channel are serialized by mu, not blocking other channels.
+type historyFile struct {
+	mu     sync.Mutex
+	f      *os.File      // opened on first append
+	elem   *list.Element // in lru if f is open
+	n      int           // number of messages in the file, -1 if not loaded
+	used   time.Time     // when it was appended or queried last
+	closed bool          // unloaded, the channel is loaded again by a new one
+}
+
+// close the file opened.
+func (hf *historyFile) close() error {
+	if hf.f == nil {
+		return nil
+	}
+	err := hf.f.Close()
+	hf.f = nil
+	return err
+}
+
+func (h *fileHistory) Append(key string, sig *psig.Signalling, size int, ttl time.Duration) error {
+	hf, err := h.acquire(key)
+	if err != nil {
+		return err
+	}
+	defer hf.mu.Unlock()
+	h.mem.Append(key, sig, size, ttl)
+
+	buf, err := msgpack.Marshal(sig)
+	if err != nil {
+		return err
+	}
+	if hf.f == nil {
+		if hf.f, err = os.OpenFile(h.path(key), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err != nil {
+			return err
+		}
+	}
+	h.touch(hf)
+	if _, err = hf.f.Write(buf); err != nil {
+		return err
+	}
+	hf.n++
+	if hf.n > 2*size {
+		return h.compact(key, hf)
+	}
+	return nil
+}
+
+func (h *fileHistory) Query(key string, q HistoryQuery) ([]*psig.Signalling, error) {
+	hf, err := h.acquire(key)
+	if err != nil {
+		return nil, err
+	}
+	defer hf.mu.Unlock()
+	return h.mem.Query(key, q)
+}
+
+// acquire returns the file of key locked, the file is loaded if not yet.
+func (h *fileHistory) acquire(key string) (*historyFile, error) {
+	for {
+		now := time.Now()
+		h.mu.Lock()
+		h.sweepLocked(now)
+		hf := h.files[key]
+		if hf == nil {
+			hf = &historyFile{n: -1}
+			h.files[key] = hf
+		}
+		h.mu.Unlock()
+
+		hf.mu.Lock()
+		if hf.closed {
+			// unloaded by sweep in between
+			hf.mu.Unlock()
+			continue
+		}
+		hf.used = now
+		if hf.n < 0 {
+			if err := h.load(key, hf); err != nil {
+				hf.mu.Unlock()
+				return nil, err
+			}
+		}
+		return hf, nil
+	}
+}
+
+// touch moves the file of hf to the front of lru, and closes the least
+// recently appended ones over maxOpen, hf.mu is held by caller. Files being
+// appended are skipped without waiting, so the limit may be exceeded
+// shortly.
+func (h *fileHistory) touch(hf *historyFile) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hf.elem == nil {
+		hf.elem = h.lru.PushFront(hf)
+	} else {
+		h.lru.MoveToFront(hf.elem)
+	}
+	for e := h.lru.Back(); e != nil && h.maxOpen > 0 && h.lru.Len() > h.maxOpen; {
+		prev := e.Prev()
+		if old := e.Value.(*historyFile); old != hf && old.mu.TryLock() {
+			h.untrackLocked(old)
+			if err := old.close(); err != nil {
+				log.Error("history.close error", "err", err)
+			}
+			old.mu.Unlock()
+		}
+		e = prev
+	}
+}
+
+// untrackLocked removes hf from lru, h.mu is held by caller.
+func (h *fileHistory) untrackLocked(hf *historyFile) {
+	if hf.elem != nil {
+		h.lru.Remove(hf.elem)
+		hf.elem = nil
+	}
+}
+
+// sweepLocked unloads the channels idle, at most once per half of idle.
+// Channels busy are not idle, so they are skipped without waiting.
+func (h *fileHistory) sweepLocked(now time.Time) {
+	if h.idle == 0 || now.Sub(h.swept) < h.idle/2 {
+		return
+	}
+	h.swept = now
+	for key, hf := range h.files {
+		if !hf.mu.TryLock() {
+			continue
+		}
+		if now.Sub(hf.used) > h.idle {
+			h.untrackLocked(hf)
+			if err := hf.close(); err != nil {
+				log.Error("history.close error", "key", key, "err", err)
+			}
+			hf.closed = true
+			delete(h.files, key)
+			h.mem.drop(key)
+		}
+		hf.mu.Unlock()
+	}
+}
+
+// path returns the file of channel history.
+func (h *fileHistory) path(key string) string {
+	return filepath.Join(h.dir, url.PathEscape(key)+".history")
+}
+
+// load reads the file of key into memory, hf.mu is held by caller.
+func (h *fileHistory) load(key string, hf *historyFile) error {
+	data, err := os.ReadFile(h.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		hf.n = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []*psig.Signalling
+	r := bytes.NewReader(data)
+	dec := msgpack.NewDecoder(r)
+	for r.Len() > 0 {
+		sig := &psig.Signalling{}
+		if err = dec.Decode(sig); err != nil {
+			break
+		}
+		entries = append(entries, sig)
+	}
+
+	l := &historyLog{}
+	for _, sig := range entries {
+		l.push(sig, len(entries))
+	}
+	h.mem.mu.Lock()
+	h.mem.logs[key] = l
+	h.mem.mu.Unlock()
+	hf.n = len(entries)
+
+	// the tail written partially by a crash is dropped, or appends after it
+	// can not be read
+	if err != nil {
+		log.Error("history.load truncated", "key", key, "messages", len(entries), "err", err)
+		return h.compact(key, hf)
+	}
+	return nil
+}
+
+// compact rewrites the file of key by the messages in memory, hf.mu is held
+// by caller. The file opened is closed, as it is replaced, and opened again
+// on next append.
+func (h *fileHistory) compact(key string, hf *historyFile) error {
+	h.mu.Lock()
+	h.untrackLocked(hf)
+	h.mu.Unlock()
+	if err := hf.close(); err != nil {
+		return err
+	}
+	h.mem.mu.Lock()
+	var entries []*psig.Signalling
+	if l := h.mem.logs[key]; l != nil {
+		entries = l.all()
+	}
+	h.mem.mu.Unlock()
+
+	tmp := h.path(key) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := msgpack.NewEncoder(f)
+	for _, sig := range entries {
+		if err = enc.Encode(sig); err != nil {
+			break
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, h.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	hf.n = len(entries)
+	return nil
+}
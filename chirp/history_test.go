@@ -0,0 +1,268 @@
+package chirp
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+// appendHistory appends messages published on origin "us" by seq from 1.
+func appendHistory(t *testing.T, store HistoryStore, key string, size int, ttl time.Duration, payloads ...string) {
+	t.Helper()
+	all, _ := store.Query(key, HistoryQuery{})
+	var seq uint64
+	if len(all) > 0 {
+		seq = all[len(all)-1].Seq
+	}
+	for _, pl := range payloads {
+		seq++
+		sig := &psig.Signalling{Type: psig.SigData, Payload: []byte(pl), Origin: "us", Seq: seq, Ts: time.Now().UnixMilli()}
+		if err := store.Append(key, sig, size, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func payloadsOf(sigs []*psig.Signalling) string {
+	var s string
+	for _, sig := range sigs {
+		s += string(sig.Payload)
+	}
+	return s
+}
+
+func Test_MemoryHistory(t *testing.T) {
+	store := NewMemoryHistory(0)
+	appendHistory(t, store, "app/room", 3, 0, "a", "b", "c", "d")
+
+	sigs, _ := store.Query("app/room", HistoryQuery{})
+	assert(t, payloadsOf(sigs) == "bcd", "last 3 messages should be kept, got %q", payloadsOf(sigs))
+	sigs, _ = store.Query("app/other", HistoryQuery{})
+	assert(t, len(sigs) == 0, "no history of other channel, got %d", len(sigs))
+
+	// size changed by policy
+	appendHistory(t, store, "app/room", 5, 0, "e", "f")
+	sigs, _ = store.Query("app/room", HistoryQuery{})
+	assert(t, payloadsOf(sigs) == "bcdef", "history should grow, got %q", payloadsOf(sigs))
+	appendHistory(t, store, "app/room", 2, 0, "g")
+	sigs, _ = store.Query("app/room", HistoryQuery{})
+	assert(t, payloadsOf(sigs) == "fg", "history should shrink, got %q", payloadsOf(sigs))
+
+	// expired by ttl
+	old := &psig.Signalling{Type: psig.SigData, Payload: []byte("x"), Ts: time.Now().Add(-time.Hour).UnixMilli()}
+	store.Append("app/ttl", old, 10, time.Minute)
+	appendHistory(t, store, "app/ttl", 10, time.Minute, "y")
+	sigs, _ = store.Query("app/ttl", HistoryQuery{})
+	assert(t, payloadsOf(sigs) == "y", "expired message should be evicted, got %q", payloadsOf(sigs))
+}
+
+func Test_MemoryHistoryIdle(t *testing.T) {
+	store := NewMemoryHistory(20 * time.Millisecond)
+	appendHistory(t, store, "app/room", 3, 0, "a")
+	appendHistory(t, store, "app/busy", 3, 0, "b")
+	time.Sleep(30 * time.Millisecond)
+	appendHistory(t, store, "app/busy", 3, 0, "c")
+
+	sigs, _ := store.Query("app/room", HistoryQuery{})
+	assert(t, len(sigs) == 0, "history of idle channel should be dropped, got %q", payloadsOf(sigs))
+	sigs, _ = store.Query("app/busy", HistoryQuery{})
+	assert(t, payloadsOf(sigs) == "bc", "history of busy channel should be kept, got %q", payloadsOf(sigs))
+}
+
+func Test_HistoryQuery(t *testing.T) {
+	store := NewMemoryHistory(0)
+	appendHistory(t, store, "app/room", 10, 0, "a", "b", "c", "d")
+	store.Append("app/room", &psig.Signalling{Type: psig.SigData, Payload: []byte("e"), Origin: "eu", Seq: 3, Ts: time.Now().UnixMilli()}, 10, 0)
+
+	cases := []struct {
+		q    HistoryQuery
+		want string
+	}{
+		{HistoryQuery{}, "abcde"},
+		{HistoryQuery{Origin: "us", After: 1}, "bcd"},
+		{HistoryQuery{Origin: "us", After: 1, Until: 3}, "bc"},
+		{HistoryQuery{Origin: "eu"}, "e"},
+		{HistoryQuery{Ts: time.Now().Add(time.Minute).UnixMilli()}, ""},
+	}
+	for _, c := range cases {
+		sigs, _ := store.Query("app/room", c.q)
+		assert(t, payloadsOf(sigs) == c.want, "query %+v, want %q, got %q", c.q, c.want, payloadsOf(sigs))
+	}
+}
+
+func Test_FileHistory(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileHistory(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendHistory(t, store, "app/room", 2, 0, "a", "b", "c", "d", "e")
+
+	// reloaded after restart, compacted to the messages kept
+	store, _ = NewFileHistory(dir, 0, 0)
+	sigs, err := store.Query("app/room", HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, payloadsOf(sigs) == "de" && sigs[1].Seq == 5 && sigs[1].Origin == "us", "history should be reloaded, got %q", payloadsOf(sigs))
+	appendHistory(t, store, "app/room", 2, 0, "f")
+	sigs, _ = store.Query("app/room", HistoryQuery{})
+	assert(t, payloadsOf(sigs) == "ef", "history after reloaded, got %q", payloadsOf(sigs))
+
+	// a partially written tail is dropped
+	path := store.(*fileHistory).path("app/room")
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	f.Write([]byte{0x8f, 0xa1})
+	f.Close()
+	store, _ = NewFileHistory(dir, 0, 0)
+	appendHistory(t, store, "app/room", 2, 0, "g")
+	store, _ = NewFileHistory(dir, 0, 0)
+	sigs, _ = store.Query("app/room", HistoryQuery{})
+	assert(t, payloadsOf(sigs) == "defg", "truncated tail should be dropped, got %q", payloadsOf(sigs))
+}
+
+func Test_FileHistoryIdle(t *testing.T) {
+	store, err := NewFileHistory(t.TempDir(), 20*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := store.(*fileHistory)
+	appendHistory(t, store, "app/room", 3, 0, "a", "b")
+	hf := h.files["app/room"]
+	assert(t, hf != nil && hf.f != nil && hf.n == 2, "file should be kept open, got %+v", hf)
+
+	time.Sleep(30 * time.Millisecond)
+	appendHistory(t, store, "app/other", 3, 0, "x")
+	assert(t, h.files["app/room"] == nil && hf.closed && hf.f == nil, "idle channel should be unloaded, got %+v", hf)
+	h.mem.mu.Lock()
+	_, ok := h.mem.logs["app/room"]
+	h.mem.mu.Unlock()
+	assert(t, !ok, "history of idle channel should be dropped from memory")
+
+	// loaded again from file
+	appendHistory(t, store, "app/room", 3, 0, "c")
+	sigs, _ := store.Query("app/room", HistoryQuery{})
+	assert(t, payloadsOf(sigs) == "abc", "history should be reloaded, got %q", payloadsOf(sigs))
+}
+
+func Test_FileHistoryMaxOpen(t *testing.T) {
+	store, err := NewFileHistory(t.TempDir(), 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := store.(*fileHistory)
+	appendHistory(t, store, "app/a", 3, 0, "a")
+	appendHistory(t, store, "app/b", 3, 0, "b")
+	appendHistory(t, store, "app/c", 3, 0, "c")
+	assert(t, h.lru.Len() == 2 && h.files["app/a"].f == nil, "least recently appended file should be closed, %d open", h.lru.Len())
+	assert(t, h.files["app/b"].f != nil && h.files["app/c"].f != nil, "recently appended files should be kept open")
+
+	// opened again on next append
+	appendHistory(t, store, "app/a", 3, 0, "d")
+	assert(t, h.lru.Len() == 2 && h.files["app/a"].f != nil && h.files["app/b"].f == nil, "files open should be capped, %d open", h.lru.Len())
+	reopened, _ := NewFileHistory(h.dir, 0, 2)
+	sigs, _ := reopened.Query("app/a", HistoryQuery{})
+	assert(t, payloadsOf(sigs) == "ad", "history should be appended after reopened, got %q", payloadsOf(sigs))
+}
+
+func Test_ReplayHistory(t *testing.T) {
+	defer func(fn func(string, string) (int, time.Duration)) { HistoryPolicy = fn }(HistoryPolicy)
+	HistoryPolicy = func(appID, channel string) (int, time.Duration) {
+		if channel == "history-room" {
+			return 10, time.Minute
+		}
+		return 0, 0
+	}
+
+	// a fresh store per run, the global one may be used by runs before
+	defer func(fn func() HistoryStore) { historyStore = fn }(historyStore)
+	store := NewMemoryHistory(0)
+	historyStore = func() HistoryStore { return store }
+
+	t.Setenv("MESH_ID", "us")
+	sndr := &captureSender{sigs: make(chan *psig.Signalling, 1)}
+	realm := &node{id: "history_app", sndr: sndr}
+	alice := realm.AddPeer(NewMockConnection("history-a"), "alice")
+	alice.Join("history-room")
+	alice.Join("no-history-room")
+	c := realm.FindChannel("history-room")
+	for i, pl := range []string{"a", "b", "c"} {
+		buf, _ := alice.Codec.Marshal(&psig.Signalling{Type: psig.SigData, Channel: "history-room", Payload: []byte(pl), Seq: 100})
+		if err := alice.HandleSignal(bytes.NewReader(buf)); err != nil {
+			t.Fatal(err)
+		}
+		// stamped by origin, then dispatched back over the mesh
+		sig := <-sndr.sigs
+		assert(t, sig.Seq == uint64(i+1) && sig.Origin == seqOrigin() && sig.Ts > 0, "published message should be stamped, got %+v", sig)
+		c.Dispatch(sig)
+	}
+	realm.FindChannel("no-history-room").Dispatch(&psig.Signalling{Type: psig.SigData, Channel: "no-history-room", Payload: []byte("z")})
+
+	decode := func(msg []byte) *psig.Signalling {
+		var sig psig.Signalling
+		if err := psig.Msgpack.Decode(bytes.NewReader(msg), &sig); err != nil {
+			t.Fatal(err)
+		}
+		return &sig
+	}
+
+	// replayed on join since ts
+	bobConn := newRecordConnection("history-b")
+	bob := realm.AddPeer(bobConn, "bob")
+	buf, _ := bob.Codec.Marshal(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpChannelJoin, Channel: "history-room", Ts: 1})
+	if err := bob.HandleSignal(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, bobConn.count() == 5, "ACK, 3 messages and end of history, got %d", bobConn.count())
+	sig := decode(bobConn.msgs[1])
+	assert(t, sig.Type == psig.SigData && string(sig.Payload) == "a" && sig.Cid == "alice" && sig.Sid == "" && sig.Seq == 1, "replayed message, got %+v", sig)
+	sig = decode(bobConn.msgs[4])
+	assert(t, sig.OpCode == psig.OpHistory && sig.Ts == 1, "end of history, got %+v", sig)
+
+	// missing range requested by `history`
+	bobConn.msgs = nil
+	buf, _ = bob.Codec.Marshal(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpHistory, Channel: "history-room", Origin: seqOrigin(), Seq: 1, End: 2})
+	if err := bob.HandleSignal(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, bobConn.count() == 2 && decode(bobConn.msgs[0]).Seq == 2, "only seq 2 should be replayed, got %d", bobConn.count())
+	sig = decode(bobConn.msgs[1])
+	assert(t, sig.OpCode == psig.OpHistory && sig.Origin == seqOrigin() && sig.Seq == 1 && sig.End == 2, "request should be echoed, got %+v", sig)
+
+	// channel without history
+	bob.Join("no-history-room")
+	bobConn.msgs = nil
+	buf, _ = bob.Codec.Marshal(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpHistory, Channel: "no-history-room"})
+	bob.HandleSignal(bytes.NewReader(buf))
+	assert(t, bobConn.count() == 1 && decode(bobConn.msgs[0]).OpCode == psig.OpHistory, "no history, got %d", bobConn.count())
+
+	buf, _ = bob.Codec.Marshal(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpHistory, Channel: "not-joined"})
+	err := bob.HandleSignal(bytes.NewReader(buf))
+	assert(t, err == ErrChannelNotJoined, "channel should be joined, got %v", err)
+}
+
+func Test_PublishOrdered(t *testing.T) {
+	t.Setenv("MESH_ID", "us")
+	sndr := &captureSender{sigs: make(chan *psig.Signalling, 100)}
+	realm := &node{id: "ordered_app", sndr: sndr}
+	c := realm.GetOrAddChannel("ordered-room")
+	for i := range 100 {
+		c.publish(&psig.Signalling{Type: psig.SigData, Channel: "ordered-room", Payload: []byte(strconv.Itoa(i))})
+	}
+	for i := range 100 {
+		sig := <-sndr.sigs
+		assert(t, sig.Seq == uint64(i+1) && string(sig.Payload) == strconv.Itoa(i), "messages should be sent in order published, got %+v", sig)
+		assert(t, strings.HasPrefix(sig.Origin, "us:") && len(sig.Origin) > len("us:"), "origin should be unique per boot, got %q", sig.Origin)
+	}
+
+	// sent unnumbered without origin
+	t.Setenv("MESH_ID", "")
+	c.publish(&psig.Signalling{Type: psig.SigData, Channel: "ordered-room", Payload: []byte("x"), Seq: 7, Origin: "forged"})
+	sig := <-sndr.sigs
+	assert(t, string(sig.Payload) == "x" && sig.Seq == 0 && sig.Origin == "" && sig.Ts > 0, "data without origin should be sent unnumbered, got %+v", sig)
+}
@@ -0,0 +1,104 @@
+package chirp
+
+import (
+	"sync"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+// memberRegistry tracks the connections of each client id in a channel on
+// all nodes, so a user connecting more than once, like from several browser
+// tabs, is announced `peer_online` by the first connection and
+// `peer_offline` by the last one only. Nodes stamp presence signallings with
+// the connections of sender on them, and every node sums them up when
+// dispatching.
+type memberRegistry struct {
+	mu    sync.Mutex
+	conns map[string]map[string]int // connections by client id then by mesh id
+}
+
+// observe updates the connections of sender by the presence signalling, and
+// replaces `sig.Conns` with the total on all nodes. It returns false if the
+// signalling should not be delivered, as other connections of sender are
+// still in the channel.
+func (r *memberRegistry) observe(sig *psig.Signalling) bool {
+	switch sig.OpCode {
+	case psig.OpPeerOnline, psig.OpState:
+		// not stamped by nodes of older versions
+		if sig.Conns <= 0 {
+			return true
+		}
+	case psig.OpPeerOffline:
+	default:
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	before := r.totalLocked(sig.Cid)
+	if sig.Conns > 0 {
+		if r.conns == nil {
+			r.conns = make(map[string]map[string]int)
+		}
+		if r.conns[sig.Cid] == nil {
+			r.conns[sig.Cid] = make(map[string]int)
+		}
+		r.conns[sig.Cid][sig.MeshID] = sig.Conns
+	} else if nodes := r.conns[sig.Cid]; nodes != nil {
+		delete(nodes, sig.MeshID)
+		if len(nodes) == 0 {
+			delete(r.conns, sig.Cid)
+		}
+	}
+	after := r.totalLocked(sig.Cid)
+	sig.Conns = after
+
+	switch sig.OpCode {
+	case psig.OpPeerOnline:
+		return before == 0
+	case psig.OpPeerOffline:
+		return after == 0
+	}
+	return true
+}
+
+// cidsOn returns the client ids with connections on the node of mesh id.
+func (r *memberRegistry) cidsOn(meshID string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var cids []string
+	for cid, nodes := range r.conns {
+		if _, ok := nodes[meshID]; ok {
+			cids = append(cids, cid)
+		}
+	}
+	return cids
+}
+
+// has tells if client id has connections in the channel on any node.
+func (r *memberRegistry) has(cid string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.totalLocked(cid) > 0
+}
+
+func (r *memberRegistry) totalLocked(cid string) int {
+	var total int
+	for _, n := range r.conns[cid] {
+		total += n
+	}
+	return total
+}
+
+// connsOf returns the number of connections of client id in this channel
+// on this node.
+func (c *Channel) connsOf(cid string) int {
+	var count int
+	c.pdic.Range(func(_, v any) bool {
+		if v.(*Peer).Cid == cid {
+			count++
+		}
+		return true
+	})
+	return count
+}
@@ -0,0 +1,120 @@
+package chirp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+func Test_MemberRegistry(t *testing.T) {
+	var r memberRegistry
+	online := func(mesh string, conns int) (*psig.Signalling, bool) {
+		sig := &psig.Signalling{Type: psig.SigControl, OpCode: psig.OpPeerOnline, Cid: "alice", MeshID: mesh, Conns: conns}
+		return sig, r.observe(sig)
+	}
+	offline := func(mesh string, conns int) (*psig.Signalling, bool) {
+		sig := &psig.Signalling{Type: psig.SigControl, OpCode: psig.OpPeerOffline, Cid: "alice", MeshID: mesh, Conns: conns}
+		return sig, r.observe(sig)
+	}
+
+	sig, ok := online("us", 1)
+	assert(t, ok && sig.Conns == 1, "first connection should be online, got %v %d", ok, sig.Conns)
+	sig, ok = online("us", 2)
+	assert(t, !ok && sig.Conns == 2, "second tab should not be online, got %v %d", ok, sig.Conns)
+	sig, ok = online("eu", 1)
+	assert(t, !ok && sig.Conns == 3, "connection on other node should not be online, got %v %d", ok, sig.Conns)
+
+	sig, ok = offline("us", 0)
+	assert(t, !ok && sig.Conns == 1, "connection on other node is left, got %v %d", ok, sig.Conns)
+	sig, ok = offline("eu", 0)
+	assert(t, ok && sig.Conns == 0, "last connection should be offline, got %v %d", ok, sig.Conns)
+	assert(t, len(r.conns) == 0, "registry should be empty, got %v", r.conns)
+
+	// signallings not stamped are delivered as before
+	sig, ok = online("old", 0)
+	assert(t, ok && sig.Conns == 0, "not stamped should be delivered, got %v %d", ok, sig.Conns)
+	ok = r.observe(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpState, Cid: "alice", MeshID: "us", Conns: 2})
+	assert(t, ok && r.totalLocked("alice") == 2, "peer_state should be delivered and counted")
+}
+
+func Test_MultiConnectionPeer(t *testing.T) {
+	sndr := &captureSender{sigs: make(chan *psig.Signalling, 1)}
+	realm := &node{id: "multi_conn_app", sndr: sndr}
+	tab1 := realm.AddPeer(NewMockConnection("multi-1"), "alice")
+	tab2 := realm.AddPeer(NewMockConnection("multi-2"), "alice")
+	realm.AddPeer(NewMockConnection("multi-3"), "bob").Join("multi-room")
+	tab1.Join("multi-room")
+	tab2.Join("multi-room")
+
+	assert(t, len(realm.Presence("multi-room")) == 2, "alice should be listed once, got %v", realm.Presence("multi-room"))
+	conns := realm.PresenceConns("multi-room")
+	assert(t, conns["alice"] == 2 && conns["bob"] == 1, "connections of peers, got %v", conns)
+
+	broadcast := func() *psig.Signalling {
+		select {
+		case sig := <-sndr.sigs:
+			return sig
+		case <-time.After(time.Second):
+			t.Fatal("signalling should be broadcast")
+		}
+		return nil
+	}
+
+	buf, _ := tab2.Codec.Marshal(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpPeerOnline, Channel: "multi-room"})
+	if err := tab2.HandleSignal(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+	sig := broadcast()
+	assert(t, sig.OpCode == psig.OpPeerOnline && sig.Conns == 2, "peer_online should be stamped, got %+v", sig)
+
+	tab1.Leave("multi-room")
+	sig = broadcast()
+	assert(t, sig.OpCode == psig.OpPeerOffline && sig.Conns == 1, "peer_offline should be stamped, got %+v", sig)
+	tab2.Leave("multi-room")
+	sig = broadcast()
+	assert(t, sig.OpCode == psig.OpPeerOffline && sig.Conns == 0, "last connection left, got %+v", sig)
+}
+
+func Test_MeshNodeGone(t *testing.T) {
+	t.Setenv("MESH_ID", "us")
+	realm := &node{id: "node_gone_app", sndr: &MockSender{}}
+	bobConn := newRecordConnection("node-gone-b")
+	realm.AddPeer(bobConn, "bob").Join("gone-room")
+	c := realm.FindChannel("gone-room")
+	online := func(cid, mesh string) {
+		c.Dispatch(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpPeerOnline, Channel: "gone-room", Cid: cid, MeshID: mesh, Conns: 1})
+	}
+
+	// alice is on the node eu, carol on eu and ap
+	realm.nodeAlive("eu", "eu:1")
+	realm.nodeAlive("ap", "ap:1")
+	online("alice", "eu")
+	online("carol", "eu")
+	online("carol", "ap")
+	bobConn.msgs = nil
+
+	// the node eu is gone without heartbeat
+	time.Sleep(5 * time.Millisecond)
+	realm.nodeAlive("ap", "ap:1")
+	realm.expireNodes(time.Now().Add(-time.Millisecond))
+	assert(t, bobConn.count() == 1, "alice should be offline, got %d", bobConn.count())
+
+	var sig psig.Signalling
+	if err := psig.Msgpack.Decode(bytes.NewReader(bobConn.msgs[0]), &sig); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, sig.OpCode == psig.OpPeerOffline && sig.Cid == "alice", "peer_offline of alice, got %+v", sig)
+	assert(t, !c.members.has("alice") && c.members.has("carol"), "members on gone nodes only should be dropped")
+
+	// alice comes back on another node, announced online again
+	bobConn.msgs = nil
+	online("alice", "ap")
+	assert(t, bobConn.count() == 1, "alice should be online again, got %d", bobConn.count())
+
+	// the members on the previous boot of a restarted node are dropped
+	bobConn.msgs = nil
+	realm.nodeAlive("ap", "ap:2")
+	assert(t, bobConn.count() == 2 && !c.members.has("alice") && !c.members.has("carol"), "members on restarted node should be offline, got %d", bobConn.count())
+}
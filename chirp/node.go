@@ -1,9 +1,12 @@
 package chirp
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pilarjs/prscd/psig"
@@ -36,6 +39,7 @@ func GetOrCreateRealm(appID string, credential string) (realm *node) {
 		log.Debug("create realm", "appID", appID)
 		// connect to yomo zipper when created
 		err := res.(*node).ConnectToYoMo(credential)
+		setMeshErr(err)
 		// if can not connect to yomo zipper, remove this realm
 		if err != nil {
 			allRealms.Delete(appID)
@@ -49,27 +53,44 @@ func GetOrCreateRealm(appID string, credential string) (realm *node) {
 }
 
 type node struct {
-	id     string              // id is the unique id of this node
-	cdic   sync.Map            // all channels on this node
-	pdic   sync.Map            // all peers on this node
-	Env    string              // Env describes the environment of this node, e.g. "dev", "prod"
-	MeshID string              // MeshID describes the id of this node
-	sndr   yomo.Source         // the yomo source used to send data to the geo-distributed network which built by yomo
-	rcvr   yomo.StreamFunction // the yomo stream function used to receive data from the geo-distributed network which built by yomo
+	id        string                      // id is the unique id of this node
+	cdic      sync.Map                    // all channels on this node
+	pdic      sync.Map                    // all peers on this node
+	peers     atomic.Int64                // number of peers in pdic
+	cidMu     sync.RWMutex                // guards cids
+	cids      map[string]map[string]*Peer // peers by client id then by sid, a client may connect more than once
+	Env       string                      // Env describes the environment of this node, e.g. "dev", "prod"
+	MeshID    string                      // MeshID describes the id of this node
+	sndr      yomo.Source                 // the yomo source used to send data to the geo-distributed network which built by yomo
+	rcvr      yomo.StreamFunction         // the yomo stream function used to receive data from the geo-distributed network which built by yomo
+	batch     batcher                     // signallings pending to send to other nodes if batching
+	batchOnce sync.Once
+	nodes     meshNodes // other nodes alive by heartbeats
 }
 
 // AddPeer add peer to channel named `cid` on this node.
 func (n *node) AddPeer(conn Connection, cid string) *Peer {
 	log.Debug("node.add_peer", "remoteAddr", conn.RemoteAddr(), "cid", cid)
+	sid := conn.RemoteAddr()
+	if c, ok := conn.(Identifier); ok {
+		sid = c.ID()
+	}
 	peer := &Peer{
-		Sid:      conn.RemoteAddr(),
+		Sid:      sid,
 		Cid:      cid,
 		Channels: make(map[string]*Channel),
+		Version:  psig.DefaultVersion,
+		Codec:    psig.Msgpack,
 		conn:     conn,
 		realm:    n,
 	}
 
-	n.pdic.Store(peer.Sid, peer)
+	if old, loaded := n.pdic.Swap(peer.Sid, peer); !loaded {
+		n.peers.Add(1)
+	} else {
+		n.unindexPeer(old.(*Peer))
+	}
+	n.indexPeer(peer)
 
 	return peer
 }
@@ -77,7 +98,93 @@ func (n *node) AddPeer(conn Connection, cid string) *Peer {
 // RemovePeer remove peer on this node.
 func (n *node) RemovePeer(pid string) {
 	log.Info("node.remove_peer", "pid", pid)
-	n.pdic.Delete(pid)
+	if old, loaded := n.pdic.LoadAndDelete(pid); loaded {
+		n.peers.Add(-1)
+		n.unindexPeer(old.(*Peer))
+	}
+}
+
+// removePeer removes p on this node, unless it is replaced by another peer
+// of the same sid.
+func (n *node) removePeer(p *Peer) {
+	log.Info("node.remove_peer", "pid", p.Sid)
+	if n.pdic.CompareAndDelete(p.Sid, p) {
+		n.peers.Add(-1)
+		n.unindexPeer(p)
+	}
+}
+
+// indexPeer adds p to the index by client id.
+func (n *node) indexPeer(p *Peer) {
+	n.cidMu.Lock()
+	defer n.cidMu.Unlock()
+	if n.cids == nil {
+		n.cids = make(map[string]map[string]*Peer)
+	}
+	if n.cids[p.Cid] == nil {
+		n.cids[p.Cid] = make(map[string]*Peer)
+	}
+	n.cids[p.Cid][p.Sid] = p
+}
+
+// unindexPeer removes p from the index by client id.
+func (n *node) unindexPeer(p *Peer) {
+	n.cidMu.Lock()
+	defer n.cidMu.Unlock()
+	n.unindexPeerLocked(p)
+}
+
+func (n *node) unindexPeerLocked(p *Peer) {
+	peers := n.cids[p.Cid]
+	if peers[p.Sid] != p {
+		return
+	}
+	delete(peers, p.Sid)
+	if len(peers) == 0 {
+		delete(n.cids, p.Cid)
+	}
+}
+
+var (
+	// ErrCidVerified is returned when changing the client id verified by
+	// client certificate.
+	ErrCidVerified = errors.New("client id is verified by certificate")
+)
+
+// setCid changes the client id of p, and moves it in the index.
+func (n *node) setCid(p *Peer, cid string) error {
+	if p.CidVerified {
+		return ErrCidVerified
+	}
+	if reservedCid(n.id, cid) {
+		return ErrCidReserved
+	}
+	n.cidMu.Lock()
+	defer n.cidMu.Unlock()
+	if cid == p.Cid {
+		return nil
+	}
+	n.unindexPeerLocked(p)
+	p.Cid = cid
+	if n.cids == nil {
+		n.cids = make(map[string]map[string]*Peer)
+	}
+	if n.cids[cid] == nil {
+		n.cids[cid] = make(map[string]*Peer)
+	}
+	n.cids[cid][p.Sid] = p
+	return nil
+}
+
+// PeersByCid returns the peers of client id on this node.
+func (n *node) PeersByCid(cid string) []*Peer {
+	n.cidMu.RLock()
+	defer n.cidMu.RUnlock()
+	peers := make([]*Peer, 0, len(n.cids[cid]))
+	for _, p := range n.cids[cid] {
+		peers = append(peers, p)
+	}
+	return peers
 }
 
 // GetOrCreateChannel get or create channel on this node.
@@ -143,27 +250,24 @@ func (n *node) ConnectToYoMo(credential string) error {
 		err := msgpack.Unmarshal(ctx.Data(), &sig)
 		if err != nil {
 			log.Error("Read from YoMo error", "err", err, "ctx.Data()", ctx.Data())
+			return
 		}
-		log.Debug("got sig", "sig", sig)
-
-		// if sig.AppID != n.id {
-		// 	log.Debug("ignore message from other app", "appID", sig.AppID)
-		// 	return
-		// }
-
-		channel := n.FindChannel(sig.Channel)
-		if channel != nil {
-			channel.Dispatch(sig)
-			log.Debug("[\u21CA] dispatched to", "cid", sig.Cid)
-		} else {
-			log.Debug("[\u21CA] dispatch to channel failed cause of not exist", "channel", sig.Channel)
+		// signallings batched by other nodes are handled in order
+		if sig.Type == psig.SigBatch {
+			log.Debug("got batch", "tag", ctx.Tag(), "signals", len(sig.Batch))
+			for _, s := range sig.Batch {
+				n.handleFromYoMo(s)
+			}
+			return
 		}
+		n.handleFromYoMo(sig)
 	}
 
 	// set observe data tags from yomo network by yomo stream function
 	// 0x20 comes from other prscd nodes
 	// 0x21 comes from backend sfn
-	rcvr.SetObserveDataTags(0x20, 0x21)
+	// 0x22 comes from other prscd nodes batching signallings
+	rcvr.SetObserveDataTags(0x20, 0x21, 0x22)
 
 	// handle data from yomo network, and dispatch to the same channel on this node.
 	rcvr.SetHandler(sfnHandler)
@@ -175,9 +279,45 @@ func (n *node) ConnectToYoMo(credential string) error {
 
 	n.sndr = sndr
 	n.rcvr = rcvr
+	go n.heartbeat()
 	return nil
 }
 
+// handleFromYoMo dispatches the signalling from the geo-distributed network
+// to the peers on this node.
+func (n *node) handleFromYoMo(sig *psig.Signalling) {
+	log.Debug("got sig", "sig", sig)
+
+	// if sig.AppID != n.id {
+	// 	log.Debug("ignore message from other app", "appID", sig.AppID)
+	// 	return
+	// }
+
+	if sig.Type == psig.SigControl && sig.OpCode == psig.OpNodeAlive {
+		if sig.AppID == n.id {
+			n.nodeAlive(sig.MeshID, sig.Origin)
+		}
+		return
+	}
+
+	// direct signals are delivered to the peers of receiver on this node,
+	// client ids are only unique in an app
+	if sig.Type == psig.SigDirect {
+		if sig.AppID == n.id {
+			n.DispatchDirect(sig)
+		}
+		return
+	}
+
+	channel := n.FindChannel(sig.Channel)
+	if channel != nil {
+		channel.Dispatch(sig)
+		log.Debug("[\u21CA] dispatched to", "cid", sig.Cid)
+	} else {
+		log.Debug("[\u21CA] dispatch to channel failed cause of not exist", "channel", sig.Channel)
+	}
+}
+
 // BroadcastToYoMo broadcast presence to yomo
 func (n *node) BroadcastToYoMo(sig *psig.Signalling) {
 	// sig.Sid is sender's sid when sending message
@@ -187,18 +327,127 @@ func (n *node) BroadcastToYoMo(sig *psig.Signalling) {
 		log.Error("msgpack marshal: %+v", err)
 		return
 	}
+	n.sendToYoMo(buf)
+}
 
+// writeToYoMo writes buf to the geo-distributed network with tag.
+func (n *node) writeToYoMo(tag uint32, buf []byte) {
 	if n.sndr == nil {
 		log.Error("************** n.sndr is nil")
 		return
 	}
 
-	err = n.sndr.Write(0x20, buf)
+	err := n.sndr.Write(tag, buf)
 	if err != nil {
 		log.Error("broadcast to yomo error: %+v", err)
 	}
 }
 
+// Publish a data signalling to the channel on behalf of cid, which is sent
+// by server other than a peer, e.g. by the REST API. It is broadcast to all
+// peers of the channel over the mesh, returns false if the channel does not
+// exist on this node, channels are never created by publishing.
+func (n *node) Publish(channel, cid string, payload []byte) bool {
+	c := n.FindChannel(channel)
+	if c == nil {
+		return false
+	}
+	c.Broadcast(&psig.Signalling{
+		Type:    psig.SigData,
+		Channel: channel,
+		Cid:     cid,
+		Payload: payload,
+	})
+	return true
+}
+
+// Presence returns the client ids of peers in the channel on this node, a
+// client connected more than once is listed once.
+func (n *node) Presence(channel string) []string {
+	conns := n.PresenceConns(channel)
+	cids := make([]string, 0, len(conns))
+	for cid := range conns {
+		cids = append(cids, cid)
+	}
+	slices.Sort(cids)
+	return cids
+}
+
+// PresenceConns returns the number of connections of each client id in the
+// channel on this node.
+func (n *node) PresenceConns(channel string) map[string]int {
+	conns := map[string]int{}
+	c := n.FindChannel(channel)
+	if c == nil {
+		return conns
+	}
+	c.pdic.Range(func(_, v any) bool {
+		conns[v.(*Peer).Cid]++
+		return true
+	})
+	return conns
+}
+
+// PresenceRTT returns the RTT of peers in the channel on this node by their
+// client ids, peers not measured yet are omitted.
+func (n *node) PresenceRTT(channel string) map[string]*psig.RTT {
+	rtts := map[string]*psig.RTT{}
+	c := n.FindChannel(channel)
+	if c == nil {
+		return rtts
+	}
+	c.pdic.Range(func(_, v any) bool {
+		p := v.(*Peer)
+		if rtt := p.RTT(); rtt != nil {
+			rtts[p.Cid] = rtt
+		}
+		return true
+	})
+	return rtts
+}
+
+// PeerInfo describes a peer on this node, listed by the admin API.
+type PeerInfo struct {
+	AppID    string    `json:"app_id"`
+	Sid      string    `json:"sid"`
+	Cid      string    `json:"cid"`
+	Version  string    `json:"version"`
+	Channels []string  `json:"channels"`
+	RTT      *psig.RTT `json:"rtt,omitempty"`
+}
+
+// Peers returns the peers on this node of appID, or of all apps if appID is
+// empty.
+func Peers(appID string) []PeerInfo {
+	peers := []PeerInfo{}
+	allRealms.Range(func(k, realm any) bool {
+		if appID != "" && k.(string) != appID {
+			return true
+		}
+		realm.(*node).pdic.Range(func(_, v any) bool {
+			p := v.(*Peer)
+			info := PeerInfo{
+				AppID:    k.(string),
+				Sid:      p.Sid,
+				Cid:      p.Cid,
+				Version:  string(p.Version),
+				Channels: []string{},
+				RTT:      p.RTT(),
+			}
+			p.mu.Lock()
+			for name := range p.Channels {
+				info.Channels = append(info.Channels, name)
+			}
+			p.mu.Unlock()
+			slices.Sort(info.Channels)
+			peers = append(peers, info)
+			return true
+		})
+		return true
+	})
+	return peers
+}
+
 // DumpNodeState prints the user and room information to stdout.
 func DumpNodeState() {
 	log.Info("Dump start --------")
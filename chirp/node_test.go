@@ -3,6 +3,7 @@ package chirp
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/pilarjs/prscd/util"
 	"github.com/yomorun/yomo"
@@ -52,6 +53,10 @@ func (s *MockSender) WriteWithTarget(tag frame.Tag, data []byte, target string)
 
 var channelName, peerName string
 var appID = "test_appid"
+
+// the realm connected to zipper sends no heartbeat, which would race with
+// the tests overriding the config of mesh
+var _ = os.Setenv("MESH_HEARTBEAT_INTERVAL", "0")
 var n = GetOrCreateRealm(appID, os.Getenv("YOMO_CREDENTIAL"))
 
 func init() {
@@ -128,3 +133,24 @@ func Test_node_AuthUser(t *testing.T) {
 		t.Errorf("node.AuthUser() gotOk = %v, want %v", gotOk, true)
 	}
 }
+
+func Test_node_Publish(t *testing.T) {
+	sndr := &tagSender{}
+	realm := &node{id: "publish_app", sndr: sndr}
+	assert(t, !realm.Publish("publish-room", "server", []byte("hi")), "publish should fail if channel not exists")
+	assert(t, realm.FindChannel("publish-room") == nil, "publish should not create channel")
+
+	realm.AddPeer(newRecordConnection("publish-a"), "alice").Join("publish-room")
+	assert(t, realm.Publish("publish-room", "server", []byte("hi")), "publish to existing channel should succeed")
+	deadline := time.Now().Add(time.Second)
+	for {
+		sndr.mu.Lock()
+		n := len(sndr.data)
+		sndr.mu.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			assert(t, n > 0, "published signal should be sent to mesh")
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,61 @@
+package chirp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AllowedOrigins returns the origins allowed to connect to the app, set by
+// developer like AuthUserAndGetYoMoCredential. An origin pattern is either
+// exact like `https://example.com`, or wildcard like `https://*.example.com`
+// which matches any subdomain, or `*` which matches any origin. Any origin is
+// allowed if the hook is nil or returns nothing.
+var AllowedOrigins func(appID string) []string
+
+// ErrOriginNotAllowed is returned when the origin of client is not allowed by the app.
+var ErrOriginNotAllowed = errors.New("origin not allowed")
+
+// CheckOrigin checks the `Origin` header of the connecting request against
+// the allowed origins of the app, the same check applies to all transports.
+// Requests without origin are not sent by browsers and not subject to CSRF,
+// they are allowed.
+func CheckOrigin(appID, origin string) error {
+	if AllowedOrigins == nil || origin == "" {
+		return nil
+	}
+	patterns := AllowedOrigins(appID)
+	if len(patterns) == 0 {
+		return nil
+	}
+	for _, pattern := range patterns {
+		if matchOrigin(pattern, origin) {
+			return nil
+		}
+	}
+	stats.Add("origin_rejected", 1)
+	log.Info("origin rejected", "appID", appID, "origin", origin)
+	return fmt.Errorf("%w: %q", ErrOriginNotAllowed, origin)
+}
+
+// matchOrigin tells if origin matches the pattern, case-insensitive.
+func matchOrigin(pattern, origin string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "/"))
+	origin = strings.ToLower(origin)
+	if pattern == "*" {
+		return true
+	}
+	prefix, suffix, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == origin
+	}
+	// `*` only matches subdomains, like `https://*.example.com`
+	if !strings.HasPrefix(suffix, ".") || len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	sub := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(sub, "/:@")
+}
@@ -0,0 +1,57 @@
+package chirp
+
+import (
+	"errors"
+	"expvar"
+	"testing"
+)
+
+func Test_MatchOrigin(t *testing.T) {
+	cases := []struct {
+		pattern, origin string
+		want            bool
+	}{
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com/", "https://EXAMPLE.com", true},
+		{"https://example.com", "http://example.com", false},
+		{"https://example.com", "https://example.com:8443", false},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://evil.com/.example.com", false},
+		{"https://*.example.com", "https://evilexample.com", false},
+		{"*", "https://any.site", true},
+	}
+	for _, c := range cases {
+		got := matchOrigin(c.pattern, c.origin)
+		assert(t, got == c.want, "matchOrigin(%q, %q) should be %v", c.pattern, c.origin, c.want)
+	}
+}
+
+func Test_CheckOrigin(t *testing.T) {
+	defer func(fn func(string) []string) { AllowedOrigins = fn }(AllowedOrigins)
+
+	AllowedOrigins = nil
+	assert(t, CheckOrigin("app", "https://evil.com") == nil, "any origin should be allowed without hook")
+
+	AllowedOrigins = func(appID string) []string {
+		if appID == "app" {
+			return []string{"https://example.com", "https://*.example.com"}
+		}
+		return nil
+	}
+	assert(t, CheckOrigin("app", "https://app.example.com") == nil, "origin should be allowed")
+	assert(t, CheckOrigin("app", "") == nil, "request without origin should be allowed")
+	assert(t, CheckOrigin("other", "https://evil.com") == nil, "app without list should allow any origin")
+
+	rejected := func() int64 {
+		if v, ok := stats.Get("origin_rejected").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := rejected()
+	err := CheckOrigin("app", "https://evil.com")
+	assert(t, errors.Is(err, ErrOriginNotAllowed), "should be ErrOriginNotAllowed, but got %v", err)
+	assert(t, rejected() == before+1, "rejection should be counted")
+}
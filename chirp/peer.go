@@ -6,7 +6,6 @@ import (
 	"sync"
 
 	"github.com/pilarjs/prscd/psig"
-	"github.com/vmihailenco/msgpack/v5"
 )
 
 // Peer describes user on this node.
@@ -17,10 +16,23 @@ type Peer struct {
 	Cid string
 	// Channel describes the channel which this peer joined.
 	Channels map[string]*Channel
+	// Version describes the protocol version negotiated with this peer when connecting.
+	Version psig.Version
+	// Codec describes how signalling is encoded between this peer and prscd.
+	Codec psig.Codec
+	// CidVerified tells Cid is verified by client certificate, it can not be
+	// changed by `peer_state` signalling.
+	CidVerified bool
 	// conn is the connection of this peer.
 	conn  Connection
 	mu    sync.Mutex
 	realm *node
+	rtt   rttStats // RTT between this peer and this node
+	// outbox holds the messages dispatched while writing to a slow peer
+	outbox outbox
+	// batch holds the messages pending to write if batching
+	batch     batcher
+	batchOnce sync.Once
 }
 
 // Join this peer to channel named `channelName`.
@@ -32,25 +44,28 @@ func (p *Peer) Join(channelName string) {
 	c.AddPeer(p)
 
 	// and this channel to peer's channel list
+	p.mu.Lock()
 	p.Channels[channelName] = c
+	p.mu.Unlock()
 
 	// ACK to peer has joined
 	p.NotifyBack(NewSigChannelJoined(channelName))
+	p.notifyCalls(c)
 
 	log.Info("peer.join_chanel ACK", "sid", p.Sid, "uniqID", c.UniqID, "cid", p.Cid)
 }
 
 // NotifyBack to peer with message.
 func (p *Peer) NotifyBack(sig *psig.Signalling) {
-	resp, err := msgpack.Marshal(sig)
+	resp, err := p.Codec.Marshal(sig)
 	if err != nil {
-		log.Error("msgpack marshal error", "err", err)
+		log.Error("marshal error", "codec", p.Codec.Name(), "err", err)
 	}
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	err = p.conn.Write(resp)
+	err = p.write(resp)
 
 	if err != nil {
 		log.Error("NotifyBack error", "err", err)
@@ -74,8 +89,11 @@ func (p *Peer) Leave(channelName string) {
 
 	c.RemovePeer(p)
 
-	// Notify others on this channel that this peer has left
-	c.Broadcast(NewSigPeerOffline(channelName, p))
+	// Notify others on this channel that this peer has left, they are
+	// notified only if it is the last connection of client id
+	sig := NewSigPeerOffline(channelName, p)
+	sig.Conns = c.connsOf(p.Cid)
+	c.Broadcast(sig)
 	log.Info("peer.leave", "sid", p.Sid, "uniqID", c.UniqID)
 }
 
@@ -87,7 +105,7 @@ func (p *Peer) Disconnect() {
 		p.Leave(ch.UniqID)
 	}
 	// wipe this peer from current node
-	p.realm.RemovePeer(p.Sid)
+	p.realm.removePeer(p)
 }
 
 // BroadcastToChannel will broadcast message to channel.
@@ -102,12 +120,22 @@ func (p *Peer) BroadcastToChannel(sig *psig.Signalling) {
 	c.Broadcast(sig)
 }
 
+// stampConns stamps the signalling with the connections of client id of
+// this peer in the channel on this node.
+func (p *Peer) stampConns(sig *psig.Signalling) {
+	p.mu.Lock()
+	c := p.Channels[sig.Channel]
+	p.mu.Unlock()
+	if c != nil {
+		sig.Conns = c.connsOf(p.Cid)
+	}
+}
+
 // HandleSignal handle message sent from connection.
 func (p *Peer) HandleSignal(r io.Reader) error {
-	decoder := msgpack.NewDecoder(r)
 	sig := &psig.Signalling{}
-	if err := decoder.Decode(sig); err != nil {
-		log.Error("msgpack.decode err, ignore", "err", err)
+	if err := p.Codec.Decode(r, sig); err != nil {
+		log.Error("decode err, ignore", "codec", p.Codec.Name(), "err", err)
 		return err
 	}
 
@@ -121,28 +149,58 @@ func (p *Peer) HandleSignal(r io.Reader) error {
 		case psig.OpChannelJoin: // `channel_join` signalling
 			// join channel
 			p.Join(sig.Channel)
+			// replay the history if requested like `history`
+			if sig.Ts > 0 || sig.Origin != "" {
+				return p.replayHistory(p.realm.FindChannel(sig.Channel), sig)
+			}
+		case psig.OpHistory: // `history` signalling
+			p.mu.Lock()
+			c := p.Channels[sig.Channel]
+			p.mu.Unlock()
+			if c == nil {
+				log.Error("peer.history error", "sid", p.Sid, "channel", sig.Channel, "err", ErrChannelNotJoined)
+				return ErrChannelNotJoined
+			}
+			return p.replayHistory(c, sig)
 		case psig.OpState: // `peer_state` signalling
 			// Alice can notify Bob that her state has been updated, also,
 			// Bob can use this signalling to initialize or update Alice's state
 			if sig.Sid != "" && sig.Cid != "" {
-				// if peer sid and client id are both set, then update the client id of this peer
-				p.Cid = sig.Cid
-				log.Info("peer state new ClientID", "sid", p.Sid, "cid", p.Cid)
+				// if peer sid and client id are both set, then update the client id of this peer,
+				// unless it is verified by certificate or reserved for it
+				if err := p.realm.setCid(p, sig.Cid); err != nil {
+					log.Error("peer state ClientID rejected", "sid", p.Sid, "cid", p.Cid, "new", sig.Cid, "err", err)
+				} else {
+					log.Info("peer state new ClientID", "sid", p.Sid, "cid", p.Cid)
+				}
 			}
+			// the connection quality of sender is measured by server, not
+			// declared by client
+			sig.RTT = p.RTT()
+			p.stampConns(sig)
 			p.BroadcastToChannel(sig)
 		case psig.OpPeerOffline: // `peer_offline` signalling
 			p.Leave(sig.Channel)
 		case psig.OpPeerOnline: // `peer_online` signalling
+			// others are notified only if it is the first connection of
+			// client id
+			sig.RTT = p.RTT()
+			p.stampConns(sig)
 			p.BroadcastToChannel(sig)
+		case psig.OpRTCOffer, psig.OpRTCAnswer, psig.OpRTCCandidate, psig.OpRTCHangup:
+			return p.SendRTC(sig)
 		default:
 			log.Error("Unknown control opcode", "code", sig.OpCode)
 		}
 	} else if sig.Type == psig.SigData {
 		// handle the Data Signalling
 		p.BroadcastToChannel(sig)
+	} else if sig.Type == psig.SigDirect {
+		// handle the Direct Signalling
+		return p.SendDirect(sig)
 	} else {
-		log.Error("ILLEGAL sig.Type, should be `data` or `control`", "sig", sig)
-		return errors.New("ILLEGAL sig.Type, should be `data` or `control`")
+		log.Error("ILLEGAL sig.Type, should be `data`, `control` or `direct`", "sig", sig)
+		return errors.New("ILLEGAL sig.Type, should be `data`, `control` or `direct`")
 	}
 
 	return nil
@@ -0,0 +1,36 @@
+package chirp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PeerQuota returns the max number of peers of the app on this node, set by
+// developer like AllowedOrigins. There is no limit if the hook is nil or
+// returns 0.
+var PeerQuota func(appID string) int
+
+// ErrPeerQuotaExceeded is returned when the app reaches its quota of peers.
+var ErrPeerQuotaExceeded = errors.New("peer quota exceeded")
+
+// CheckPeerQuota checks if the app can accept one more peer on this node,
+// the same check applies to all transports.
+func CheckPeerQuota(appID string) error {
+	if PeerQuota == nil {
+		return nil
+	}
+	limit := PeerQuota(appID)
+	if limit <= 0 {
+		return nil
+	}
+	res, ok := allRealms.Load(appID)
+	if !ok {
+		return nil
+	}
+	if res.(*node).peers.Load() >= int64(limit) {
+		stats.Add("quota_rejected", 1)
+		log.Info("peer quota exceeded", "appID", appID, "quota", limit)
+		return fmt.Errorf("%w: %d", ErrPeerQuotaExceeded, limit)
+	}
+	return nil
+}
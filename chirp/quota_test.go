@@ -0,0 +1,37 @@
+package chirp
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_CheckPeerQuota(t *testing.T) {
+	defer func(fn func(string) int) { PeerQuota = fn }(PeerQuota)
+
+	const quotaApp = "quota_app"
+	realm := &node{id: quotaApp, sndr: &MockSender{}}
+	allRealms.Store(quotaApp, realm)
+	defer allRealms.Delete(quotaApp)
+
+	PeerQuota = nil
+	assert(t, CheckPeerQuota(quotaApp) == nil, "no limit without hook")
+
+	PeerQuota = func(appID string) int {
+		if appID == quotaApp {
+			return 2
+		}
+		return 0
+	}
+	realm.AddPeer(NewMockConnection("quota-1"), "c1")
+	// the same sid replaces the peer, not counted twice
+	realm.AddPeer(NewMockConnection("quota-1"), "c1")
+	assert(t, CheckPeerQuota(quotaApp) == nil, "quota should not be reached by 1 peer")
+
+	realm.AddPeer(NewMockConnection("quota-2"), "c2")
+	err := CheckPeerQuota(quotaApp)
+	assert(t, errors.Is(err, ErrPeerQuotaExceeded), "quota should be reached by 2 peers, got %v", err)
+	assert(t, CheckPeerQuota("other_app") == nil, "other apps should not be limited")
+
+	realm.RemovePeer("quota-2")
+	assert(t, CheckPeerQuota(quotaApp) == nil, "quota should be released when peer removed")
+}
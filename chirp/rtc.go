@@ -0,0 +1,266 @@
+package chirp
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/pilarjs/prscd/psig"
+	"github.com/pilarjs/prscd/util"
+)
+
+var (
+	// ErrSDPTooLarge is returned when the payload of a WebRTC signal exceeds `RTC_MAX_SDP_SIZE`.
+	ErrSDPTooLarge = errors.New("sdp too large")
+	// ErrEmptySDP is returned when an offer or answer carries no SDP.
+	ErrEmptySDP = errors.New("sdp is empty")
+	// ErrSelfCall is returned when a WebRTC signal is sent to the sender itself.
+	ErrSelfCall = errors.New("can not call self")
+	// ErrCalleeNotInChannel is returned when an offer is sent to a client id
+	// not in the channel.
+	ErrCalleeNotInChannel = errors.New("callee is not in channel")
+	// ErrTooManyCalls is returned when an offer exceeds the calls allowed in
+	// the channel or of the caller.
+	ErrTooManyCalls = errors.New("too many calls")
+)
+
+// maxSDPSize limits the payload of WebRTC signals, set by env
+// `RTC_MAX_SDP_SIZE` in bytes, default 16KiB.
+var maxSDPSize = sync.OnceValue(func() int {
+	return util.GetEnvInt("RTC_MAX_SDP_SIZE", 16*1024)
+})
+
+// callLimits describes how many calls are tracked, in a channel and of a
+// caller, and how long an offer waits for the answer.
+type callLimits struct {
+	maxCalls     int
+	maxPerCaller int
+	offerTimeout time.Duration
+}
+
+// rtcCallLimits returns the limits of calls, set by env `RTC_MAX_CALLS`
+// (default 256), `RTC_MAX_CALLS_PER_PEER` (default 8) and
+// `RTC_OFFER_TIMEOUT` (default 1m).
+var rtcCallLimits = sync.OnceValue(func() callLimits {
+	return callLimits{
+		maxCalls:     util.GetEnvInt("RTC_MAX_CALLS", 256),
+		maxPerCaller: util.GetEnvInt("RTC_MAX_CALLS_PER_PEER", 8),
+		offerTimeout: max(util.GetEnvDuration("RTC_OFFER_TIMEOUT", time.Minute), 0),
+	}
+})
+
+// SendRTC validates the WebRTC signal of this peer, then broadcasts it to
+// the channel over the mesh. Nodes track the calls of the channel by it, and
+// deliver it to the peers of client id `sig.To` only, a hangup without `To`
+// is delivered to the whole channel.
+func (p *Peer) SendRTC(sig *psig.Signalling) error {
+	if err := p.validateRTC(sig); err != nil {
+		stats.Add("rtc_rejected", 1)
+		log.Error("peer.send_rtc error", "sid", p.Sid, "op", sig.OpCode, "channel", sig.Channel, "err", err)
+		return err
+	}
+	p.BroadcastToChannel(sig)
+	return nil
+}
+
+func (p *Peer) validateRTC(sig *psig.Signalling) error {
+	p.mu.Lock()
+	c, joined := p.Channels[sig.Channel]
+	p.mu.Unlock()
+	if !joined {
+		return ErrChannelNotJoined
+	}
+	if sig.To == "" && sig.OpCode != psig.OpRTCHangup {
+		return ErrNoReceiver
+	}
+	if sig.To == p.Cid {
+		return ErrSelfCall
+	}
+	if len(sig.Payload) > maxSDPSize() {
+		return fmt.Errorf("%w: %d > %d bytes", ErrSDPTooLarge, len(sig.Payload), maxSDPSize())
+	}
+	if len(sig.Payload) == 0 && (sig.OpCode == psig.OpRTCOffer || sig.OpCode == psig.OpRTCAnswer) {
+		return ErrEmptySDP
+	}
+	if sig.OpCode == psig.OpRTCOffer {
+		if !c.hasMember(sig.To) {
+			return ErrCalleeNotInChannel
+		}
+		if !c.calls.admit(p.Cid, sig.To) {
+			return ErrTooManyCalls
+		}
+	}
+	return nil
+}
+
+// hasMember tells if client id is in this channel, on this node or others.
+func (c *Channel) hasMember(cid string) bool {
+	return c.connsOf(cid) > 0 || c.members.has(cid)
+}
+
+// callRegistry tracks the calls of a channel, observed from the signals
+// dispatched to it. A call is identified by the pair of client ids, so
+// renegotiation by either side does not start another call.
+type callRegistry struct {
+	mu    sync.Mutex
+	calls map[string]*psig.Call
+}
+
+// callKey returns the same key for the calls a->b and b->a.
+func callKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "\x00" + b
+}
+
+// observe updates the calls by the control signal from cid `sig.Cid`, an
+// offer starts a call only if the callee is a member of the channel, and the
+// call is within limits.
+func (r *callRegistry) observe(sig *psig.Signalling, isMember func(cid string) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch sig.OpCode {
+	case psig.OpRTCOffer:
+		if r.calls == nil {
+			r.calls = make(map[string]*psig.Call)
+		}
+		key := callKey(sig.Cid, sig.To)
+		if _, ok := r.calls[key]; ok {
+			return
+		}
+		if !isMember(sig.To) || !r.admitLocked(sig.Cid, sig.To) {
+			stats.Add("rtc_calls_dropped", 1)
+			return
+		}
+		r.calls[key] = &psig.Call{Caller: sig.Cid, Callee: sig.To, State: psig.CallOffered, Since: time.Now().UnixMilli()}
+	case psig.OpRTCAnswer:
+		if call, ok := r.calls[callKey(sig.Cid, sig.To)]; ok {
+			call.State = psig.CallActive
+		}
+	case psig.OpRTCHangup:
+		if sig.To != "" {
+			delete(r.calls, callKey(sig.Cid, sig.To))
+		} else {
+			r.removeLocked(sig.Cid)
+		}
+	case psig.OpPeerOffline:
+		r.removeLocked(sig.Cid)
+	}
+}
+
+// admit tells if the call from caller to callee is tracked or within limits.
+func (r *callRegistry) admit(caller, callee string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.admitLocked(caller, callee)
+}
+
+func (r *callRegistry) admitLocked(caller, callee string) bool {
+	if _, ok := r.calls[callKey(caller, callee)]; ok {
+		return true
+	}
+	r.expireLocked()
+	limits := rtcCallLimits()
+	if limits.maxCalls > 0 && len(r.calls) >= limits.maxCalls {
+		return false
+	}
+	if limits.maxPerCaller > 0 {
+		var n int
+		for _, call := range r.calls {
+			if call.Caller == caller {
+				n++
+			}
+		}
+		if n >= limits.maxPerCaller {
+			return false
+		}
+	}
+	return true
+}
+
+// expireLocked removes the calls offered but not answered in time.
+func (r *callRegistry) expireLocked() {
+	timeout := rtcCallLimits().offerTimeout
+	if timeout == 0 {
+		return
+	}
+	deadline := time.Now().Add(-timeout).UnixMilli()
+	for key, call := range r.calls {
+		if call.State == psig.CallOffered && call.Since < deadline {
+			delete(r.calls, key)
+		}
+	}
+}
+
+// removeLocked removes the calls of cid.
+func (r *callRegistry) removeLocked(cid string) {
+	for key, call := range r.calls {
+		if call.Caller == cid || call.Callee == cid {
+			delete(r.calls, key)
+		}
+	}
+}
+
+// list returns the calls ordered by the time offered.
+func (r *callRegistry) list() []psig.Call {
+	r.mu.Lock()
+	r.expireLocked()
+	calls := make([]psig.Call, 0, len(r.calls))
+	for _, call := range r.calls {
+		calls = append(calls, *call)
+	}
+	r.mu.Unlock()
+	slices.SortFunc(calls, func(a, b psig.Call) int {
+		return cmp.Or(cmp.Compare(a.Since, b.Since), strings.Compare(a.Caller, b.Caller))
+	})
+	return calls
+}
+
+// Calls returns the calls of the channel tracked by this node.
+func (c *Channel) Calls() []psig.Call {
+	return c.calls.list()
+}
+
+// NewSigRTCCalls create OpRTCCalls message, the calls are encoded in the
+// payload by codec, so JSON clients get a JSON array.
+func NewSigRTCCalls(chName string, calls []psig.Call, codec psig.Codec) (*psig.Signalling, error) {
+	var pl []byte
+	var err error
+	if codec.Text() {
+		pl, err = json.Marshal(calls)
+	} else {
+		pl, err = msgpack.Marshal(calls)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &psig.Signalling{
+		Type:    psig.SigControl,
+		OpCode:  psig.OpRTCCalls,
+		Channel: chName,
+		Payload: pl,
+	}, nil
+}
+
+// notifyCalls tells the peer joined the channel about its calls, so late
+// joiners can see them.
+func (p *Peer) notifyCalls(c *Channel) {
+	calls := c.Calls()
+	if len(calls) == 0 {
+		return
+	}
+	sig, err := NewSigRTCCalls(c.UniqID, calls, p.Codec)
+	if err != nil {
+		log.Error("marshal calls error", "codec", p.Codec.Name(), "err", err)
+		return
+	}
+	p.NotifyBack(sig)
+}
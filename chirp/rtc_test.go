@@ -0,0 +1,137 @@
+package chirp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+func Test_SendRTC(t *testing.T) {
+	sndr := &captureSender{sigs: make(chan *psig.Signalling, 1)}
+	realm := &node{id: "send_rtc_app", sndr: sndr}
+	alice := realm.AddPeer(NewMockConnection("send-rtc-a"), "alice")
+	alice.Join("rtc-room")
+
+	cases := []struct {
+		sig *psig.Signalling
+		err error
+	}{
+		{&psig.Signalling{OpCode: psig.OpRTCOffer, Channel: "not-joined", To: "bob", Payload: []byte("v=0")}, ErrChannelNotJoined},
+		{&psig.Signalling{OpCode: psig.OpRTCOffer, Channel: "rtc-room", Payload: []byte("v=0")}, ErrNoReceiver},
+		{&psig.Signalling{OpCode: psig.OpRTCOffer, Channel: "rtc-room", To: "alice", Payload: []byte("v=0")}, ErrSelfCall},
+		{&psig.Signalling{OpCode: psig.OpRTCAnswer, Channel: "rtc-room", To: "bob"}, ErrEmptySDP},
+		{&psig.Signalling{OpCode: psig.OpRTCOffer, Channel: "rtc-room", To: "bob", Payload: make([]byte, maxSDPSize()+1)}, ErrSDPTooLarge},
+		{&psig.Signalling{OpCode: psig.OpRTCOffer, Channel: "rtc-room", To: "bob", Payload: []byte("v=0")}, ErrCalleeNotInChannel},
+	}
+	for _, c := range cases {
+		c.sig.Type = psig.SigControl
+		err := alice.SendRTC(c.sig)
+		assert(t, errors.Is(err, c.err), "%s should fail with %v, got %v", c.sig.OpCode, c.err, err)
+	}
+
+	realm.AddPeer(NewMockConnection("send-rtc-b"), "bob").Join("rtc-room")
+
+	buf, _ := alice.Codec.Marshal(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpRTCOffer, Channel: "rtc-room", To: "bob", Payload: []byte("v=0")})
+	if err := alice.HandleSignal(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sig := <-sndr.sigs:
+		assert(t, sig.OpCode == psig.OpRTCOffer && sig.Cid == "alice" && sig.To == "bob", "offer should be broadcast, got %+v", sig)
+	case <-time.After(time.Second):
+		t.Fatal("offer should be broadcast")
+	}
+}
+
+func Test_DispatchRTC(t *testing.T) {
+	realm := &node{id: "dispatch_rtc_app", sndr: &MockSender{}}
+	aliceConn, bobConn, carolConn := newRecordConnection("rtc-a"), newRecordConnection("rtc-b"), newRecordConnection("rtc-c")
+	alice := realm.AddPeer(aliceConn, "alice")
+	bob := realm.AddPeer(bobConn, "bob")
+	carol := realm.AddPeer(carolConn, "carol")
+	alice.Join("rtc-room")
+	bob.Join("rtc-room")
+	carol.Join("rtc-room")
+	c := realm.FindChannel("rtc-room")
+	for _, conn := range []*recordConnection{aliceConn, bobConn, carolConn} {
+		conn.msgs = nil
+	}
+
+	// routed to the receiver only, and tracked as a call
+	c.Dispatch(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpRTCOffer, Channel: "rtc-room", Sid: alice.Sid, Cid: "alice", To: "bob", Payload: []byte("v=0")})
+	assert(t, bobConn.count() == 1 && carolConn.count() == 0 && aliceConn.count() == 0, "offer should be sent to bob only")
+	calls := c.Calls()
+	assert(t, len(calls) == 1 && calls[0].Caller == "alice" && calls[0].Callee == "bob" && calls[0].State == psig.CallOffered, "call offered, got %+v", calls)
+
+	c.Dispatch(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpRTCAnswer, Channel: "rtc-room", Sid: bob.Sid, Cid: "bob", To: "alice", Payload: []byte("v=0")})
+	assert(t, aliceConn.count() == 1 && carolConn.count() == 0, "answer should be sent to alice only")
+	// renegotiation does not start another call
+	c.Dispatch(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpRTCOffer, Channel: "rtc-room", Sid: bob.Sid, Cid: "bob", To: "alice", Payload: []byte("v=0")})
+	calls = c.Calls()
+	assert(t, len(calls) == 1 && calls[0].Caller == "alice" && calls[0].State == psig.CallActive, "call active, got %+v", calls)
+
+	// late joiner sees the active calls
+	daveConn := newRecordConnection("rtc-d")
+	dave := realm.AddPeer(daveConn, "dave")
+	dave.Codec = psig.JSON
+	dave.Join("rtc-room")
+	assert(t, daveConn.count() == 2, "dave should get ACK and calls, got %d", daveConn.count())
+	var sig psig.Signalling
+	if err := psig.JSON.Decode(bytes.NewReader(daveConn.msgs[1]), &sig); err != nil {
+		t.Fatal(err)
+	}
+	var listed []psig.Call
+	if err := json.Unmarshal(sig.Payload, &listed); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, sig.OpCode == psig.OpRTCCalls && len(listed) == 1 && listed[0] == calls[0], "calls listed, got %s", sig.Payload)
+
+	// hangup without receiver is sent to the channel and ends all calls of sender
+	c.Dispatch(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpRTCHangup, Channel: "rtc-room", Sid: bob.Sid, Cid: "bob"})
+	assert(t, carolConn.count() == 1 && daveConn.count() == 3, "hangup should be sent to the channel")
+	assert(t, len(c.Calls()) == 0, "call should end, got %+v", c.Calls())
+
+	// calls of peer left are ended
+	c.Dispatch(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpRTCOffer, Channel: "rtc-room", Sid: carol.Sid, Cid: "carol", To: "dave", Payload: []byte("v=0")})
+	c.Dispatch(NewSigPeerOffline("rtc-room", dave))
+	assert(t, len(c.Calls()) == 0, "calls of dave should end, got %+v", c.Calls())
+}
+
+func Test_CallLimits(t *testing.T) {
+	defer func(fn func() callLimits) { rtcCallLimits = fn }(rtcCallLimits)
+	rtcCallLimits = func() callLimits {
+		return callLimits{maxCalls: 2, maxPerCaller: 1, offerTimeout: 20 * time.Millisecond}
+	}
+
+	realm := &node{id: "call_limits_app", sndr: &MockSender{}}
+	peers := make(map[string]*Peer)
+	for _, cid := range []string{"alice", "bob", "carol", "dave"} {
+		peers[cid] = realm.AddPeer(NewMockConnection("limits-"+cid), cid)
+		peers[cid].Join("limits-room")
+	}
+	c := realm.FindChannel("limits-room")
+	offer := func(from, to string) {
+		c.Dispatch(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpRTCOffer, Channel: "limits-room", Sid: peers[from].Sid, Cid: from, To: to, Payload: []byte("v=0")})
+	}
+
+	offer("alice", "nobody")
+	assert(t, len(c.Calls()) == 0, "call to non-member should not be tracked, got %+v", c.Calls())
+	offer("alice", "bob")
+	offer("alice", "carol")
+	assert(t, len(c.Calls()) == 1, "calls of caller should be limited, got %+v", c.Calls())
+	err := peers["alice"].SendRTC(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpRTCOffer, Channel: "limits-room", To: "dave", Payload: []byte("v=0")})
+	assert(t, errors.Is(err, ErrTooManyCalls), "offer over limit should be rejected, got %v", err)
+	offer("bob", "carol")
+	offer("carol", "dave")
+	assert(t, len(c.Calls()) == 2, "calls of channel should be limited, got %+v", c.Calls())
+
+	// offers not answered expire
+	time.Sleep(30 * time.Millisecond)
+	assert(t, len(c.Calls()) == 0, "offers not answered should expire, got %+v", c.Calls())
+	offer("carol", "dave")
+	assert(t, len(c.Calls()) == 1, "call should be tracked after expired ones removed, got %+v", c.Calls())
+}
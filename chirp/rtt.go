@@ -0,0 +1,113 @@
+package chirp
+
+import (
+	"expvar"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+// rttStats estimates the RTT of peer from samples like TCP does,
+// https://www.rfc-editor.org/rfc/rfc6298#section-2, or takes it from the
+// transport measuring RTT itself, like QUIC.
+type rttStats struct {
+	mu       sync.Mutex
+	samples  int
+	latest   time.Duration
+	smoothed time.Duration
+	jitter   time.Duration
+	source   func() (latest, smoothed, jitter time.Duration)
+}
+
+// UpdateRTT adds an RTT sample of this peer, like measured by WebSocket
+// Ping/Pong frames.
+func (p *Peer) UpdateRTT(sample time.Duration) {
+	s := &p.rtt
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest = sample
+	if s.samples == 0 {
+		s.smoothed, s.jitter = sample, sample/2
+	} else {
+		s.jitter = (3*s.jitter + (s.smoothed - sample).Abs()) / 4
+		s.smoothed = (7*s.smoothed + sample) / 8
+	}
+	s.samples++
+}
+
+// SetRTTSource makes the RTT of this peer taken from fn, for transports
+// measuring RTT themselves like QUIC, fn returns zero before measured.
+func (p *Peer) SetRTTSource(fn func() (latest, smoothed, jitter time.Duration)) {
+	p.rtt.mu.Lock()
+	defer p.rtt.mu.Unlock()
+	p.rtt.source = fn
+}
+
+// RTT returns the RTT of this peer, nil if not measured yet.
+func (p *Peer) RTT() *psig.RTT {
+	s := &p.rtt
+	s.mu.Lock()
+	latest, smoothed, jitter, source := s.latest, s.smoothed, s.jitter, s.source
+	measured := s.samples > 0
+	s.mu.Unlock()
+
+	if source != nil {
+		latest, smoothed, jitter = source()
+		measured = smoothed > 0
+	}
+	if !measured {
+		return nil
+	}
+	return &psig.RTT{
+		Latest:   milliseconds(latest),
+		Smoothed: milliseconds(smoothed),
+		Jitter:   milliseconds(jitter),
+	}
+}
+
+// milliseconds converts d to milliseconds, rounded to microseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func init() {
+	// summary of the smoothed RTT of peers on this node, in milliseconds
+	stats.Set("rtt_ms", expvar.Func(func() any {
+		var rtts []float64
+		allRealms.Range(func(_, realm any) bool {
+			realm.(*node).pdic.Range(func(_, v any) bool {
+				if rtt := v.(*Peer).RTT(); rtt != nil {
+					rtts = append(rtts, rtt.Smoothed)
+				}
+				return true
+			})
+			return true
+		})
+		return summarizeRTT(rtts)
+	}))
+}
+
+// summarizeRTT returns the count, average, median, 95th percentile and max
+// of rtts.
+func summarizeRTT(rtts []float64) map[string]any {
+	summary := map[string]any{"peers": len(rtts)}
+	if len(rtts) == 0 {
+		return summary
+	}
+	slices.Sort(rtts)
+	var sum float64
+	for _, v := range rtts {
+		sum += v
+	}
+	// nearest-rank percentile
+	percentile := func(p int) float64 {
+		return rtts[(len(rtts)*p+99)/100-1]
+	}
+	summary["avg"] = sum / float64(len(rtts))
+	summary["p50"] = percentile(50)
+	summary["p95"] = percentile(95)
+	summary["max"] = rtts[len(rtts)-1]
+	return summary
+}
@@ -0,0 +1,92 @@
+package chirp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/yomorun/yomo/core/frame"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+func Test_PeerRTT(t *testing.T) {
+	p := &Peer{}
+	assert(t, p.RTT() == nil, "RTT should be nil before measured")
+
+	p.UpdateRTT(20 * time.Millisecond)
+	rtt := p.RTT()
+	assert(t, rtt != nil && rtt.Latest == 20 && rtt.Smoothed == 20 && rtt.Jitter == 10, "first sample, got %+v", rtt)
+
+	// smoothed = 7/8*20 + 1/8*28, jitter = 3/4*10 + 1/4*|20-28|
+	p.UpdateRTT(28 * time.Millisecond)
+	rtt = p.RTT()
+	assert(t, rtt.Latest == 28 && rtt.Smoothed == 21 && rtt.Jitter == 9.5, "second sample, got %+v", rtt)
+
+	// RTT measured by transport takes precedence
+	p.SetRTTSource(func() (latest, smoothed, jitter time.Duration) {
+		return 0, 0, 0
+	})
+	assert(t, p.RTT() == nil, "RTT should be nil before measured by transport")
+	p.SetRTTSource(func() (latest, smoothed, jitter time.Duration) {
+		return 1500 * time.Microsecond, time.Millisecond, 250 * time.Microsecond
+	})
+	rtt = p.RTT()
+	assert(t, *rtt == psig.RTT{Latest: 1.5, Smoothed: 1, Jitter: 0.25}, "RTT of transport, got %+v", rtt)
+}
+
+// captureSender captures the signallings broadcast to YoMo.
+type captureSender struct {
+	MockSender
+	sigs chan *psig.Signalling
+}
+
+func (s *captureSender) Write(tag frame.Tag, data []byte) error {
+	var sig psig.Signalling
+	if err := msgpack.Unmarshal(data, &sig); err != nil {
+		return err
+	}
+	s.sigs <- &sig
+	return nil
+}
+
+func Test_RTTStampedOnPresence(t *testing.T) {
+	const rttApp = "rtt_app"
+	sndr := &captureSender{sigs: make(chan *psig.Signalling, 1)}
+	realm := &node{id: rttApp, sndr: sndr}
+	allRealms.Store(rttApp, realm)
+	defer allRealms.Delete(rttApp)
+
+	sender := realm.AddPeer(NewMockConnection("rtt-sender"), "rtt-alice")
+	sender.Join("rtt-room")
+	sender.UpdateRTT(10 * time.Millisecond)
+
+	// RTT declared by client is replaced by the measured one
+	buf, _ := sender.Codec.Marshal(&psig.Signalling{Type: psig.SigControl, OpCode: psig.OpState, Channel: "rtt-room", RTT: &psig.RTT{Smoothed: 1}})
+	if err := sender.HandleSignal(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sig := <-sndr.sigs:
+		assert(t, sig.RTT != nil && sig.RTT.Smoothed == 10, "RTT of sender should be stamped, got %+v", sig.RTT)
+	case <-time.After(time.Second):
+		t.Fatal("peer_state should be broadcast")
+	}
+
+	rtts := realm.PresenceRTT("rtt-room")
+	assert(t, rtts["rtt-alice"] != nil && rtts["rtt-alice"].Smoothed == 10, "presence RTT, got %+v", rtts)
+
+	peers := Peers(rttApp)
+	assert(t, len(peers) == 1, "peers of app, got %+v", peers)
+	assert(t, peers[0].Cid == "rtt-alice" && len(peers[0].Channels) == 1 && peers[0].Channels[0] == "rtt-room", "peer info, got %+v", peers[0])
+	assert(t, peers[0].RTT != nil && peers[0].RTT.Smoothed == 10, "RTT of peer, got %+v", peers[0].RTT)
+}
+
+func Test_SummarizeRTT(t *testing.T) {
+	s := summarizeRTT(nil)
+	assert(t, s["peers"] == 0 && len(s) == 1, "empty summary, got %v", s)
+
+	s = summarizeRTT([]float64{40, 10, 20, 30})
+	assert(t, s["peers"] == 4 && s["avg"] == 25.0 && s["p50"] == 20.0 && s["p95"] == 40.0 && s["max"] == 40.0, "summary, got %v", s)
+}
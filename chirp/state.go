@@ -0,0 +1,63 @@
+package chirp
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// meshErr is the error of the latest attempt to connect a realm to YoMo
+// Zipper, nil if it succeeded.
+var meshErr atomic.Pointer[error]
+
+// MeshReady returns the error of the latest attempt to connect to YoMo Zipper,
+// nil if the mesh is reachable or never tried.
+func MeshReady() error {
+	if err := meshErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func setMeshErr(err error) {
+	if err == nil {
+		meshErr.Store(nil)
+		return
+	}
+	meshErr.Store(&err)
+}
+
+// stats of this node, published as `prscd` expvar.
+var stats = expvar.NewMap("prscd")
+
+func init() {
+	stats.Set("realms", expvar.Func(func() any {
+		count := 0
+		allRealms.Range(func(_, _ any) bool {
+			count++
+			return true
+		})
+		return count
+	}))
+	stats.Set("channels", expvar.Func(func() any {
+		count := 0
+		allRealms.Range(func(_, realm any) bool {
+			realm.(*node).cdic.Range(func(_, _ any) bool {
+				count++
+				return true
+			})
+			return true
+		})
+		return count
+	}))
+	stats.Set("peers", expvar.Func(func() any {
+		count := 0
+		allRealms.Range(func(_, realm any) bool {
+			realm.(*node).pdic.Range(func(_, _ any) bool {
+				count++
+				return true
+			})
+			return true
+		})
+		return count
+	}))
+}
@@ -1,15 +1,72 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/x509"
 	"log/slog"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/pilarjs/prscd/chirp"
+	"github.com/pilarjs/prscd/util"
 )
 
+// certCidPrefix is the namespace of client ids mapped from certificates.
+const certCidPrefix = "cert:"
+
 func init() {
 	chirp.AuthUserAndGetYoMoCredential = func(publicKey string) (appID, credential string, ok bool) {
 		slog.Info("Node| auth_user", "publicKey", publicKey)
 		return "YOMO_APP", os.Getenv("YOMO_CREDENTIAL"), true
 	}
+
+	chirp.AuthAPISecret = func(secret string) (appID, credential string, ok bool) {
+		// API_SECRET authenticates REST API requests of backend services, REST API is disabled if it is empty
+		expected := os.Getenv("API_SECRET")
+		ok = expected != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1
+		return "YOMO_APP", os.Getenv("YOMO_CREDENTIAL"), ok
+	}
+
+	chirp.AuthClientCertificate = func(cert *x509.Certificate) (appID, cid, credential string, ok bool) {
+		// client id is the first DNS name of SANs, or the common name of subject, in the namespace of certificates
+		name := cert.Subject.CommonName
+		if len(cert.DNSNames) > 0 {
+			name = cert.DNSNames[0]
+		}
+		if name == "" {
+			return "", "", "", false
+		}
+		cid = certCidPrefix + name
+		slog.Info("Node| auth_client_certificate", "subject", cert.Subject.String(), "cid", cid)
+		return "YOMO_APP", cid, os.Getenv("YOMO_CREDENTIAL"), true
+	}
+
+	chirp.ReservedCid = func(appID, cid string) bool {
+		// client ids mapped from certificates can not be taken by public key clients
+		return strings.HasPrefix(cid, certCidPrefix)
+	}
+
+	chirp.PeerQuota = func(appID string) int {
+		// MAX_PEERS_PER_APP limits the peers of each app on this node, 0 means no limit
+		return util.GetEnvInt("MAX_PEERS_PER_APP", 0)
+	}
+
+	chirp.HistoryPolicy = func(appID, channel string) (int, time.Duration) {
+		// HISTORY_SIZE messages of each channel are kept for HISTORY_TTL, 0 means no history or no age limit
+		return util.GetEnvInt("HISTORY_SIZE", 0), util.GetEnvDuration("HISTORY_TTL", 0)
+	}
+
+	chirp.CoalescePolicy = func(appID, channel string) time.Duration {
+		// COALESCE_TICK collapses high-frequency updates of each channel within it, 0 means no coalescing
+		return util.GetEnvDuration("COALESCE_TICK", 0)
+	}
+
+	chirp.AllowedOrigins = func(appID string) []string {
+		// ALLOWED_ORIGINS is a comma separated list, like `https://example.com,https://*.example.com`
+		if origins := os.Getenv("ALLOWED_ORIGINS"); origins != "" {
+			return strings.Split(origins, ",")
+		}
+		return nil
+	}
 }
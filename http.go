@@ -0,0 +1,156 @@
+package prscd
+
+import (
+	"embed"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pilarjs/prscd/chirp"
+	"github.com/pilarjs/prscd/longpoll"
+	"github.com/pilarjs/prscd/psig"
+	"github.com/pilarjs/prscd/sse"
+)
+
+// Version is the version of prscd.
+const Version = "v2.1.1"
+
+// ready is set when all listeners are bound.
+var ready atomic.Bool
+
+// staticFiles are the test pages served under `/test/`.
+//
+//go:embed websocket.html webtransport.html msgpack.min.js
+var staticFiles embed.FS
+
+// newHTTPHandler returns the handler of HTTP requests served on the TLS
+// listener other than WebSocket upgrade, and on the QUIC listener other than
+// WebTransport sessions. Metrics are left to the admin listener.
+func newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	handleProbes(mux)
+	// REST APIs
+	mux.HandleFunc("POST "+chirp.Endpoint+"/channels/{channel}/publish", handlePublish)
+	mux.HandleFunc("GET "+chirp.Endpoint+"/channels/{channel}/presence", handlePresence)
+	// test pages
+	mux.Handle("GET /test/", http.StripPrefix("/test/", http.FileServerFS(staticFiles)))
+	// Server-Sent Events fallback transport
+	mux.HandleFunc(sse.SubscribePath, sse.HandleSubscribe)
+	mux.HandleFunc(sse.SendPath, sse.HandleSend)
+	// HTTP long-polling fallback transport
+	mux.HandleFunc(longpoll.ConnectPath, longpoll.HandleConnect)
+	mux.HandleFunc(longpoll.PollPath, longpoll.HandlePoll)
+	mux.HandleFunc(longpoll.SendPath, longpoll.HandleSend)
+	return mux
+}
+
+// newAdminHandler returns the handler of the admin listener, which serves
+// the endpoints for monitoring services only.
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	handleProbes(mux)
+	// expvar metrics in JSON, and the peers on this node
+	mux.Handle("GET /metrics", expvar.Handler())
+	mux.HandleFunc("GET /peers", handlePeers)
+	return mux
+}
+
+// handleProbes registers the probes of monitoring services on mux.
+func handleProbes(mux *http.ServeMux) {
+	// Health check endpoint for monitoring services (Datadog, etc.)
+	mux.HandleFunc("GET /health", handleHealth)
+	// Readiness endpoint for load balancers and orchestrators
+	mux.HandleFunc("GET /ready", handleReady)
+	mux.HandleFunc("GET /version", handleVersion)
+}
+
+// listenAdmin binds the admin listener on addr, halt if error occurs.
+func listenAdmin(addr string) net.Listener {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Info("prscd start Admin Server", "addr", addr)
+	return ln
+}
+
+// serveAdmin serves the admin endpoints in plaintext on ln, which is
+// expected to be reachable from internal network only.
+func serveAdmin(ln net.Listener) {
+	srv := &http.Server{
+		Handler:           newAdminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := srv.Serve(ln); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// withAltSvc advertises the HTTP/3 service on the same port as addr by
+// Alt-Svc header, https://www.rfc-editor.org/rfc/rfc7838.
+func withAltSvc(h http.Handler, addr string) http.Handler {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return h
+	}
+	altSvc := fmt.Sprintf(`h3=":%s"; ma=86400`, port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// handlePeers lists the peers on this node with their RTT, of all apps or
+// of `app` query param, `GET /peers?app=xxx`.
+func handlePeers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"peers": chirp.Peers(r.URL.Query().Get("app")),
+	})
+}
+
+// writeJSON responds v in JSON with status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Prscd-Version", Version)
+	h.Set("X-Prscd-MeshID", os.Getenv("MESH_ID"))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func handleHealth(w http.ResponseWriter, _ *http.Request) {
+	resString := `{"status":"healthy","service":"prscd"}`
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Prscd-Version", Version)
+	h.Set("X-Prscd-MeshID", os.Getenv("MESH_ID"))
+	h.Set("Content-Length", fmt.Sprintf("%d", len(resString)))
+	w.Write([]byte(resString))
+}
+
+// handleReady responds 503 if listeners are not started yet, or the latest
+// attempt to connect to YoMo Zipper failed.
+func handleReady(w http.ResponseWriter, _ *http.Request) {
+	if !ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+		return
+	}
+	if err := chirp.MeshReady(); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "mesh unreachable", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func handleVersion(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"version":   Version,
+		"protocols": psig.SupportedVersions,
+		"mesh_id":   os.Getenv("MESH_ID"),
+	})
+}
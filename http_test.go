@@ -0,0 +1,121 @@
+package prscd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pilarjs/prscd/chirp"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	handler := newHTTPHandler()
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	w := serve(http.MethodGet, "/health")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "healthy") {
+		t.Fatalf("health: %d %s", w.Code, w.Body)
+	}
+
+	ready.Store(false)
+	if w = serve(http.MethodGet, "/ready"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("ready should be 503 before listeners started, got %d", w.Code)
+	}
+	ready.Store(true)
+	defer ready.Store(false)
+	if w = serve(http.MethodGet, "/ready"); w.Code != http.StatusOK {
+		t.Fatalf("ready should be 200, got %d %s", w.Code, w.Body)
+	}
+
+	w = serve(http.MethodGet, "/version")
+	var v struct {
+		Version   string   `json:"version"`
+		Protocols []string `json:"protocols"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil || v.Version != Version || len(v.Protocols) == 0 {
+		t.Fatalf("version: %s, err: %v", w.Body, err)
+	}
+
+	w = httptest.NewRecorder()
+	newAdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"prscd"`) {
+		t.Fatalf("metrics should publish prscd stats: %s", w.Body)
+	}
+
+	w = serve(http.MethodGet, "/test/websocket.html")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "WebSocket") {
+		t.Fatalf("test page: %d", w.Code)
+	}
+
+	if w = serve(http.MethodPost, "/v1/channels/room-1/publish"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("publish without secret should be 401, got %d", w.Code)
+	}
+	if w = serve(http.MethodGet, "/v1/channels/room-1/publish"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("publish by GET should be 405, got %d", w.Code)
+	}
+	if w = serve(http.MethodGet, "/nope"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown path should be 404, got %d", w.Code)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	serve := func(handler http.Handler, target string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w.Code
+	}
+
+	// metrics are only served by the admin listener
+	for _, target := range []string{"/metrics", "/peers"} {
+		if code := serve(newHTTPHandler(), target); code != http.StatusNotFound {
+			t.Fatalf("%s should not be public, got %d", target, code)
+		}
+	}
+	if code := serve(newHTTPHandler(), "/health"); code != http.StatusOK {
+		t.Fatalf("health should be public, got %d", code)
+	}
+
+	admin := newAdminHandler()
+	for _, target := range []string{"/health", "/version", "/metrics", "/peers"} {
+		if code := serve(admin, target); code != http.StatusOK {
+			t.Fatalf("%s should be served by admin, got %d", target, code)
+		}
+	}
+	if code := serve(admin, "/test/websocket.html"); code != http.StatusNotFound {
+		t.Fatalf("test pages should not be served by admin, got %d", code)
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	defer func(fn func(string) (string, string, bool)) { chirp.AuthAPISecret = fn }(chirp.AuthAPISecret)
+	chirp.AuthAPISecret = func(secret string) (string, string, bool) {
+		return "api_app", "", secret == "s3cret"
+	}
+	handler := newHTTPHandler()
+	serve := func(target string, header http.Header) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader("hi"))
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// the public key of browsers is not accepted
+	if code := serve("/v1/channels/room-1/publish?publickey=pk&cid=alice", nil); code != http.StatusUnauthorized {
+		t.Fatalf("publickey query should be refused, got %d", code)
+	}
+	if code := serve("/v1/channels/room-1/publish", http.Header{"X-Prscd-Publickey": {"pk"}}); code != http.StatusUnauthorized {
+		t.Fatalf("publickey header should be refused, got %d", code)
+	}
+	if code := serve("/v1/channels/room-1/publish", http.Header{"Authorization": {"Bearer wrong"}}); code != http.StatusForbidden {
+		t.Fatalf("wrong secret should be 403, got %d", code)
+	}
+}
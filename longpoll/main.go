@@ -0,0 +1,290 @@
+// Package longpoll serves the HTTP long-polling transport for legacy clients
+// where even Server-Sent Events is unreliable. Signalling to client is
+// buffered per session until it is acked by a poll request.
+package longpoll
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pilarjs/prscd/chirp"
+	"github.com/pilarjs/prscd/psig"
+	"github.com/pilarjs/prscd/util"
+)
+
+var log = util.Log
+
+const (
+	// ConnectPath creates a session, `GET /v1/poll/connect?id=xxx&publickey=xxx`
+	// responds `{"session":"<token>"}`.
+	ConnectPath = chirp.Endpoint + "/poll/connect"
+	// PollPath responds buffered signalling as a JSON array, `GET /v1/poll?ack=<cursor>`,
+	// `DELETE /v1/poll` closes the session.
+	PollPath = chirp.Endpoint + "/poll"
+	// SendPath sends a JSON encoded signalling, `POST /v1/poll/send`.
+	SendPath = chirp.Endpoint + "/poll/send"
+	// MaxSignalSize limits the size of the body of send requests
+	MaxSignalSize = 64 << 10
+)
+
+// Options describes the settings of long-polling transport.
+type Options struct {
+	// PollTimeout is how long a poll request waits for signalling.
+	PollTimeout time.Duration
+	// SessionTTL is how long a session lives without poll requests, the peer
+	// is disconnected when the session expires.
+	SessionTTL time.Duration
+	// MaxBuffered is the max number of messages buffered between polls.
+	MaxBuffered int
+}
+
+// loadOptions loads settings from env:
+//   - LONGPOLL_TIMEOUT: default 25s
+//   - LONGPOLL_SESSION_TTL: default 60s
+//   - LONGPOLL_MAX_BUFFER: default 256 messages
+func loadOptions() Options {
+	return Options{
+		PollTimeout: util.GetEnvDuration("LONGPOLL_TIMEOUT", 25*time.Second),
+		SessionTTL:  util.GetEnvDuration("LONGPOLL_SESSION_TTL", 60*time.Second),
+		MaxBuffered: util.GetEnvInt("LONGPOLL_MAX_BUFFER", 256),
+	}
+}
+
+var (
+	// options are loaded on first use, after .env is loaded
+	options  = sync.OnceValue(loadOptions)
+	sessions sync.Map // session token -> *session
+)
+
+// session binds the requests of a client to a peer.
+type session struct {
+	token string
+	peer  *chirp.Peer
+	conn  *chirp.LongPollConnection
+
+	// sendMu serializes the signalling sent by concurrent requests, the peer
+	// handles signalling one by one like other transports do.
+	sendMu sync.Mutex
+
+	mu        sync.Mutex
+	polling   int         // number of poll requests in flight
+	expiry    *time.Timer // fires when no poll requests for SessionTTL
+	delivered uint64      // cursor of the last response written, acked by the next poll without `ack`
+	closed    bool
+}
+
+// beginPoll stops the expiry timer while a poll request is in flight.
+func (s *session) beginPoll() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.polling++
+	s.expiry.Stop()
+	return true
+}
+
+// endPoll restarts the expiry timer when the last poll request is done.
+func (s *session) endPoll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polling--
+	if s.polling == 0 && !s.closed {
+		s.expiry.Reset(options().SessionTTL)
+	}
+}
+
+// close the session, the peer leaves all channels like a disconnected WebSocket.
+func (s *session) close(reason string) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.expiry.Stop()
+	s.mu.Unlock()
+
+	log.Info("longpoll.close", "sid", s.peer.Sid, "cid", s.peer.Cid, "reason", reason)
+	sessions.Delete(s.token)
+	s.conn.Close()
+	s.peer.Disconnect()
+}
+
+// HandleConnect authenticates client the same way as WebSocket handshake
+// does, and creates a session.
+func HandleConnect(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, status, err := chirp.AuthConnectRequest(r.URL.Query(), r.Header.Get("Origin"), r.TLS)
+	if err != nil {
+		log.Error("longpoll.connect reject", "remoteAddr", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// now, the authorization is done, we can create realm instance by appID
+	node := chirp.GetOrCreateRealm(req.AppID, req.Credential)
+	if node == nil {
+		http.Error(w, "can not connect to yomo zipper", http.StatusServiceUnavailable)
+		return
+	}
+
+	token, err := util.NewSessionToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pconn := chirp.NewLongPollConnection(token, r.RemoteAddr, options().MaxBuffered)
+	peer := node.AddPeer(pconn, req.Cid)
+	peer.Version = req.Version
+	peer.Codec = psig.JSON
+	peer.CidVerified = req.CidVerified
+
+	sess := &session{
+		token: token,
+		peer:  peer,
+		conn:  pconn,
+	}
+	sess.expiry = time.AfterFunc(options().SessionTTL, func() {
+		sess.close("session expired")
+	})
+	sessions.Store(token, sess)
+	log.Info("longpoll.connect", "sid", peer.Sid, "cid", peer.Cid, "appID", req.AppID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"session": token})
+}
+
+// HandlePoll acks the messages up to the `ack` query param, and responds the
+// buffered signalling as a JSON array, waits up to PollTimeout if nothing
+// buffered. The `X-Prscd-Cursor` header is the cursor of the last message
+// responded, which should be acked by the next poll. Without `ack`, the
+// messages of the last response written are acked. The `X-Prscd-Dropped`
+// header tells client how many messages were dropped because of buffer
+// overflow since the last ack.
+func HandlePoll(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sess, ok := loadSession(r)
+	if !ok {
+		http.Error(w, "session not found", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		sess.close("closed by client")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if v := r.URL.Query().Get("ack"); v != "" {
+		ack, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "illegal ack", http.StatusBadRequest)
+			return
+		}
+		sess.conn.Ack(ack)
+	} else {
+		sess.mu.Lock()
+		sess.conn.Ack(sess.delivered)
+		sess.mu.Unlock()
+	}
+
+	if !sess.beginPoll() {
+		http.Error(w, "session not found", http.StatusUnauthorized)
+		return
+	}
+	defer sess.endPoll()
+
+	ctx, cancel := context.WithTimeout(r.Context(), options().PollTimeout)
+	defer cancel()
+	msgs, cursor, dropped, err := sess.conn.Poll(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Prscd-Cursor", strconv.FormatUint(cursor, 10))
+	if dropped > 0 {
+		h.Set("X-Prscd-Dropped", strconv.Itoa(dropped))
+	}
+	// each message is a JSON encoded signalling
+	body := append([]byte("["), bytes.Join(msgs, []byte(","))...)
+	body = append(body, ']')
+	if _, err := w.Write(body); err != nil {
+		log.Error("longpoll.poll write error, messages are kept", "sid", sess.peer.Sid, "err", err)
+		return
+	}
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		log.Error("longpoll.poll flush error, messages are kept", "sid", sess.peer.Sid, "err", err)
+		return
+	}
+	sess.mu.Lock()
+	sess.delivered = max(sess.delivered, cursor)
+	sess.mu.Unlock()
+}
+
+// HandleSend receives a JSON encoded signalling from client and handles it
+// by the peer bound to the session.
+func HandleSend(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sess, ok := loadSession(r)
+	if !ok {
+		http.Error(w, "session not found", http.StatusUnauthorized)
+		return
+	}
+
+	sess.sendMu.Lock()
+	err := sess.peer.HandleSignal(http.MaxBytesReader(w, r.Body, MaxSignalSize))
+	sess.sendMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadSession finds the session by token in `X-Prscd-Session` header or `session` query param.
+func loadSession(r *http.Request) (*session, bool) {
+	token := r.Header.Get("X-Prscd-Session")
+	if token == "" {
+		token = r.URL.Query().Get("session")
+	}
+	v, ok := sessions.Load(token)
+	if !ok {
+		return nil, false
+	}
+	return v.(*session), true
+}
@@ -0,0 +1,156 @@
+package psig
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec describes how Signalling is encoded on the wire between client and prscd.
+// Signalling between prscd nodes is always encoded by msgpack.
+type Codec interface {
+	// Name returns the name of this codec, used in subprotocol negotiation.
+	Name() string
+	// Marshal encodes the signalling.
+	Marshal(sig *Signalling) ([]byte, error)
+	// Decode reads a signalling from r.
+	Decode(r io.Reader, sig *Signalling) error
+	// Text reports whether the encoded data is UTF-8 text, WebSocket sends it in Text frames.
+	Text() bool
+	// MarshalBatch encodes the signallings already encoded by this codec in
+	// a `batch` envelope, in order.
+	MarshalBatch(msgs [][]byte) ([]byte, error)
+}
+
+var (
+	// Msgpack is the default codec, encodes Signalling by msgpack.
+	Msgpack Codec = msgpackCodec{}
+	// JSON encodes Signalling as JSON text, the payload is embedded as it is if
+	// it is a JSON object or array, otherwise it is encoded as base64 string.
+	JSON Codec = jsonCodec{}
+)
+
+// CodecByName returns the codec by its name, empty name results in Msgpack.
+func CodecByName(name string) (Codec, bool) {
+	switch name {
+	case "", Msgpack.Name():
+		return Msgpack, true
+	case JSON.Name():
+		return JSON, true
+	}
+	return nil, false
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Text() bool { return false }
+
+func (msgpackCodec) Marshal(sig *Signalling) ([]byte, error) {
+	return msgpack.Marshal(sig)
+}
+
+func (msgpackCodec) Decode(r io.Reader, sig *Signalling) error {
+	return msgpack.NewDecoder(r).Decode(sig)
+}
+
+func (msgpackCodec) MarshalBatch(msgs [][]byte) ([]byte, error) {
+	raw := make([]msgpack.RawMessage, len(msgs))
+	for i, msg := range msgs {
+		raw[i] = msg
+	}
+	return msgpack.Marshal(&struct {
+		Type  string               `msgpack:"t"`
+		Batch []msgpack.RawMessage `msgpack:"b"`
+	}{SigBatch, raw})
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Text() bool { return true }
+
+func (jsonCodec) Marshal(sig *Signalling) ([]byte, error) {
+	return json.Marshal(sig)
+}
+
+func (jsonCodec) Decode(r io.Reader, sig *Signalling) error {
+	return json.NewDecoder(r).Decode(sig)
+}
+
+func (jsonCodec) MarshalBatch(msgs [][]byte) ([]byte, error) {
+	buf := append([]byte(`{"t":"`+SigBatch+`","b":[`), bytes.Join(msgs, []byte(","))...)
+	return append(buf, "]}"...), nil
+}
+
+// signallingAlias has the same fields as Signalling without its methods,
+// avoids recursion when marshaling to JSON.
+type signallingAlias Signalling
+
+// MarshalJSON implements json.Marshaler, the payload is embedded if it is a
+// JSON object or array, otherwise it is encoded as base64 string.
+func (sig *Signalling) MarshalJSON() ([]byte, error) {
+	var pl json.RawMessage
+	if len(sig.Payload) > 0 {
+		if isJSONContainer(sig.Payload) {
+			pl = sig.Payload
+		} else {
+			pl, _ = json.Marshal(base64.StdEncoding.EncodeToString(sig.Payload))
+		}
+	}
+	return json.Marshal(&struct {
+		*signallingAlias
+		Payload json.RawMessage `json:"pl,omitempty"`
+	}{
+		signallingAlias: (*signallingAlias)(sig),
+		Payload:         pl,
+	})
+}
+
+// isJSONContainer tells if buf is a valid JSON object or array, the only
+// payloads embedded as they are, so a string payload is always base64.
+func isJSONContainer(buf []byte) bool {
+	buf = bytes.TrimSpace(buf)
+	if len(buf) == 0 || (buf[0] != '{' && buf[0] != '[') {
+		return false
+	}
+	return json.Valid(buf)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, a string payload is decoded as
+// base64, any other JSON value is kept as raw JSON bytes.
+func (sig *Signalling) UnmarshalJSON(data []byte) error {
+	aux := &struct {
+		*signallingAlias
+		Payload json.RawMessage `json:"pl,omitempty"`
+	}{
+		signallingAlias: (*signallingAlias)(sig),
+	}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+
+	pl := bytes.TrimSpace(aux.Payload)
+	switch {
+	case len(pl) == 0 || bytes.Equal(pl, []byte("null")):
+		sig.Payload = nil
+	case pl[0] == '"':
+		var s string
+		if err := json.Unmarshal(pl, &s); err != nil {
+			return err
+		}
+		buf, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		sig.Payload = buf
+	default:
+		sig.Payload = append([]byte(nil), pl...)
+	}
+	return nil
+}
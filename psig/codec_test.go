@@ -0,0 +1,101 @@
+package psig
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONCodec(t *testing.T) {
+	t.Run("embedded json payload", func(t *testing.T) {
+		sig := &Signalling{
+			Type:    SigData,
+			Channel: "room-1",
+			Payload: []byte(`{"x":1}`),
+			Cid:     "alice",
+		}
+		buf, err := JSON.Marshal(sig)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"t":"data","c":"room-1","p":"alice","pl":{"x":1}}`, string(buf))
+
+		var got Signalling
+		assert.NoError(t, JSON.Decode(bytes.NewReader(buf), &got))
+		assert.Equal(t, sig, &got)
+	})
+
+	t.Run("binary payload as base64", func(t *testing.T) {
+		sig := &Signalling{
+			Type:    SigControl,
+			OpCode:  OpState,
+			Channel: "room-1",
+			Payload: []byte{0x81, 0xa1, 0x78, 0x01},
+			Cid:     "bob",
+		}
+		buf, err := JSON.Marshal(sig)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"t":"control","op":"peer_state","c":"room-1","p":"bob","pl":"gaF4AQ=="}`, string(buf))
+
+		var got Signalling
+		assert.NoError(t, JSON.Decode(bytes.NewReader(buf), &got))
+		assert.Equal(t, sig, &got)
+	})
+
+	t.Run("round trip of non-container payloads", func(t *testing.T) {
+		for _, pl := range []string{`"hello"`, `42`, `true`, "\x00\xff binary"} {
+			sig := &Signalling{Type: SigData, Channel: "room-1", Payload: []byte(pl), Cid: "alice"}
+			buf, err := JSON.Marshal(sig)
+			assert.NoError(t, err)
+
+			var got Signalling
+			assert.NoError(t, JSON.Decode(bytes.NewReader(buf), &got))
+			assert.Equal(t, sig, &got, "payload %q encoded as %s", pl, buf)
+		}
+	})
+
+	t.Run("illegal base64 payload", func(t *testing.T) {
+		var got Signalling
+		err := JSON.Decode(bytes.NewReader([]byte(`{"t":"data","c":"room-1","pl":"not base64"}`)), &got)
+		assert.Error(t, err)
+	})
+}
+
+func TestCodecByName(t *testing.T) {
+	c, ok := CodecByName("")
+	assert.True(t, ok)
+	assert.Equal(t, Msgpack, c)
+
+	c, ok = CodecByName("json")
+	assert.True(t, ok)
+	assert.Equal(t, JSON, c)
+
+	_, ok = CodecByName("protobuf")
+	assert.False(t, ok)
+}
+
+func TestMarshalBatch(t *testing.T) {
+	sigs := []*Signalling{
+		{Type: SigData, Channel: "room-1", Payload: []byte(`{"x":1}`), Cid: "alice", Seq: 1},
+		{Type: SigControl, OpCode: OpState, Channel: "room-1", Cid: "bob"},
+	}
+	for _, codec := range []Codec{Msgpack, JSON} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			msgs := make([][]byte, len(sigs))
+			for i, sig := range sigs {
+				buf, err := codec.Marshal(sig)
+				assert.NoError(t, err)
+				msgs[i] = buf
+			}
+			buf, err := codec.MarshalBatch(msgs)
+			assert.NoError(t, err)
+
+			var got Signalling
+			assert.NoError(t, codec.Decode(bytes.NewReader(buf), &got))
+			assert.Equal(t, SigBatch, got.Type)
+			assert.Equal(t, sigs, got.Batch)
+		})
+	}
+
+	buf, _ := JSON.MarshalBatch([][]byte{[]byte(`{"t":"data","c":"a","p":""}`), []byte(`{"t":"data","c":"b","p":""}`)})
+	assert.Equal(t, `{"t":"batch","b":[{"t":"data","c":"a","p":""},{"t":"data","c":"b","p":""}]}`, string(buf))
+}
@@ -8,6 +8,10 @@ const (
 	SigControl = "control"
 	// SigData describes Data Signal
 	SigData = "data"
+	// SigDirect describes Direct Signal, which is sent to the peers of a client id only
+	SigDirect = "direct"
+	// SigBatch describes the envelope of signals in `b`, only used in server->client with protocol v3, and between prscd nodes
+	SigBatch = "batch"
 )
 
 const (
@@ -19,23 +23,82 @@ const (
 	OpPeerOnline = "peer_online"
 	// OpState only used in client->client, notify others in the channel that the peer's state has been updated.
 	OpState = "peer_state"
+	// OpHistory describes peer request the history of a joined channel since `ts`, or the range of sequence numbers (`seq`, `end`] of origin `o`, server replays the messages then echoes the request.
+	OpHistory = "history"
+	// OpNodeAlive only used between prscd nodes, tells the node `MeshID` booted as `Origin` is alive.
+	OpNodeAlive = "node_alive"
 )
 
+const (
+	// OpRTCOffer describes the SDP offer of a WebRTC call sent to the peer `To` in the channel, the payload is the SDP.
+	OpRTCOffer = "rtc_offer"
+	// OpRTCAnswer describes the SDP answer to an offer sent back to the caller `To`, the payload is the SDP.
+	OpRTCAnswer = "rtc_answer"
+	// OpRTCCandidate describes an ICE candidate sent to the other peer `To` of a call.
+	OpRTCCandidate = "rtc_candidate"
+	// OpRTCHangup describes the end of the call with peer `To`, or of all calls of sender if `To` is empty.
+	OpRTCHangup = "rtc_hangup"
+	// OpRTCCalls only used in server->client, lists the active calls of the channel to the peer joined it.
+	OpRTCCalls = "rtc_calls"
+)
+
+// IsRTC tells if opcode is a WebRTC signalling opcode sent by client.
+func IsRTC(opcode string) bool {
+	switch opcode {
+	case OpRTCOffer, OpRTCAnswer, OpRTCCandidate, OpRTCHangup:
+		return true
+	}
+	return false
+}
+
+const (
+	// CallOffered describes a call offered by caller but not answered yet.
+	CallOffered = "offered"
+	// CallActive describes a call answered by callee.
+	CallActive = "active"
+)
+
+// Call describes a WebRTC call between two peers of a channel, listed in the
+// payload of `rtc_calls`.
+type Call struct {
+	Caller string `msgpack:"caller" json:"caller"` // Caller describes the client id of the peer sent the offer
+	Callee string `msgpack:"callee" json:"callee"` // Callee describes the client id of the peer received the offer
+	State  string `msgpack:"state" json:"state"`   // State describes the state of call, `offered` or `active`
+	Since  int64  `msgpack:"since" json:"since"`   // Since describes when the call was offered, in unix milliseconds
+}
+
 // Signalling describes the message format on this geo-distributed network.
 type Signalling struct {
-	Type    string `msgpack:"t"`              // Type describes the type of signalling, `Data Signal` or `Control Signal`
-	OpCode  string `msgpack:"op,omitempty"`   // OpCode describes the operation type of signalling
-	Channel string `msgpack:"c"`              // Channel describes the channel
-	Sid     string `msgpack:"sid,omitempty"`  // Sid describes the peer id on this node in backend
-	Payload []byte `msgpack:"pl,omitempty"`   // Payload describes the payload data of signalling
-	Cid     string `msgpack:"p"`              // Cid describes the client id of peer, set by developer
-	AppID   string `msgpack:"app,omitempty"`  // AppID describes the app_id
-	MeshID  string `msgpack:"mesh,omitempty"` // MeshID describes the mesh_id of this node
+	Type    string        `msgpack:"t" json:"t"`                             // Type describes the type of signalling, `Data Signal` or `Control Signal`
+	OpCode  string        `msgpack:"op,omitempty" json:"op,omitempty"`       // OpCode describes the operation type of signalling
+	Channel string        `msgpack:"c" json:"c"`                             // Channel describes the channel
+	Sid     string        `msgpack:"sid,omitempty" json:"sid,omitempty"`     // Sid describes the peer id on this node in backend
+	Payload []byte        `msgpack:"pl,omitempty" json:"pl,omitempty"`       // Payload describes the payload data of signalling
+	Cid     string        `msgpack:"p" json:"p"`                             // Cid describes the client id of peer, set by developer
+	To      string        `msgpack:"to,omitempty" json:"to,omitempty"`       // To describes the client id of receiver of Direct Signal
+	AppID   string        `msgpack:"app,omitempty" json:"app,omitempty"`     // AppID describes the app_id
+	MeshID  string        `msgpack:"mesh,omitempty" json:"mesh,omitempty"`   // MeshID describes the mesh_id of this node
+	RTT     *RTT          `msgpack:"rtt,omitempty" json:"rtt,omitempty"`     // RTT describes the connection quality of sender, stamped by server on `peer_online` and `peer_state`
+	Conns   int           `msgpack:"conns,omitempty" json:"conns,omitempty"` // Conns describes the number of connections of sender in the channel, stamped by server on `peer_online`, `peer_state` and `peer_offline`
+	Seq     uint64        `msgpack:"seq,omitempty" json:"seq,omitempty"`     // Seq describes the sequence number of data signal in the channel on its origin node, stamped by server
+	Origin  string        `msgpack:"o,omitempty" json:"o,omitempty"`         // Origin describes the node and boot which data signal is published on, stamped by server
+	Ts      int64         `msgpack:"ts,omitempty" json:"ts,omitempty"`       // Ts describes when data signal is published, in unix milliseconds, stamped by server
+	End     uint64        `msgpack:"end,omitempty" json:"end,omitempty"`     // End describes the last sequence number of the range requested by `history`
+	Key     string        `msgpack:"k,omitempty" json:"k,omitempty"`         // Key describes what data signal updates, like `cursor`, only the latest update of the same sender and key is sent in channels coalescing updates
+	Batch   []*Signalling `msgpack:"b,omitempty" json:"b,omitempty"`         // Batch describes the signals carried by `batch` envelope, in order
+}
+
+// RTT describes the round-trip time between peer and its node in
+// milliseconds, clients can tell the connection quality of others by it.
+type RTT struct {
+	Latest   float64 `msgpack:"l" json:"l"` // Latest describes the latest sample
+	Smoothed float64 `msgpack:"s" json:"s"` // Smoothed describes the moving average of samples
+	Jitter   float64 `msgpack:"j" json:"j"` // Jitter describes the moving average of deviation from Smoothed
 }
 
 // String returns the string representation of signalling.
 func (sig *Signalling) String() string {
-	return fmt.Sprintf("meshID:%s, appID:%s, type:%s, op:%s, ch:%s, sid:%s, cid:%s, payload:(%d)", sig.MeshID, sig.AppID, sig.Type, sig.OpCode, sig.Channel, sig.Sid, sig.Cid, len(sig.Payload))
+	return fmt.Sprintf("meshID:%s, appID:%s, type:%s, op:%s, ch:%s, sid:%s, cid:%s, to:%s, payload:(%d)", sig.MeshID, sig.AppID, sig.Type, sig.OpCode, sig.Channel, sig.Sid, sig.Cid, sig.To, len(sig.Payload))
 }
 
 // Clone a signalling.
@@ -47,8 +110,17 @@ func (sig *Signalling) Clone() Signalling {
 		Sid:     sig.Sid,
 		Payload: sig.Payload,
 		Cid:     sig.Cid,
+		To:      sig.To,
 		AppID:   sig.AppID,
 		MeshID:  sig.MeshID,
+		RTT:     sig.RTT,
+		Conns:   sig.Conns,
+		Seq:     sig.Seq,
+		Origin:  sig.Origin,
+		Ts:      sig.Ts,
+		End:     sig.End,
+		Key:     sig.Key,
+		Batch:   sig.Batch,
 	}
 }
 
@@ -0,0 +1,62 @@
+package psig
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Version describes the protocol version negotiated between client and prscd
+// when the connection is established.
+type Version string
+
+const (
+	// V2 is the msgpack based signalling protocol used by Pilar.js v2 clients.
+	V2 Version = "v2"
+	// V3 is V2 with `batch` envelopes, server may send multiple signals in
+	// one message to clients speaking it.
+	V3 Version = "v3"
+)
+
+const (
+	// DefaultVersion is used when client does not declare a protocol version,
+	// clients built before version negotiation existed all speak this version.
+	DefaultVersion = V2
+)
+
+// SupportedVersions lists all protocol versions this server can speak,
+// ordered by preference.
+var SupportedVersions = []Version{V3, V2}
+
+// ErrUnsupportedVersion is returned when client requests a protocol version
+// which is not supported by this server.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// ParseVersion validates the version requested by client, an empty string
+// results in DefaultVersion.
+func ParseVersion(v string) (Version, error) {
+	if v == "" {
+		return DefaultVersion, nil
+	}
+	for _, sv := range SupportedVersions {
+		if strings.EqualFold(v, string(sv)) {
+			return sv, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q, supported: %s", ErrUnsupportedVersion, v, SupportedVersionsString())
+}
+
+// SupportedVersionsString returns the supported versions joined by comma,
+// used in response headers and rejection reasons.
+func SupportedVersionsString() string {
+	vs := make([]string, len(SupportedVersions))
+	for i, v := range SupportedVersions {
+		vs[i] = string(v)
+	}
+	return strings.Join(vs, ",")
+}
+
+// SupportsBatch reports whether clients speaking v accept `batch` envelopes.
+func (v Version) SupportsBatch() bool {
+	return v == V3
+}
@@ -0,0 +1,35 @@
+package psig
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersion(t *testing.T) {
+	t.Run("empty version falls back to default", func(t *testing.T) {
+		v, err := ParseVersion("")
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultVersion, v)
+	})
+
+	t.Run("supported version", func(t *testing.T) {
+		v, err := ParseVersion("V2")
+		assert.NoError(t, err)
+		assert.Equal(t, V2, v)
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		v, err := ParseVersion("v1")
+		assert.Empty(t, v)
+		assert.True(t, errors.Is(err, ErrUnsupportedVersion))
+		assert.EqualError(t, err, `unsupported protocol version: "v1", supported: v3,v2`)
+	})
+}
+
+func TestSupportsBatch(t *testing.T) {
+	assert.True(t, V3.SupportsBatch())
+	assert.False(t, V2.SupportsBatch())
+	assert.False(t, DefaultVersion.SupportsBatch())
+}
@@ -3,9 +3,12 @@ package prscd
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/pilarjs/prscd/util"
@@ -19,9 +22,14 @@ var log = util.Log
 
 // StartServer starts the prscd server.
 func StartServer() {
-	// check MESH_ID env
+	// MESH_ID env is required, messages are stamped by it
 	if os.Getenv("MESH_ID") == "" {
-		log.Fatal(errors.New("env check failed"))
+		log.Fatal(errors.New("MESH_ID is required"))
+	}
+
+	// the address of client can only be declared by trusted proxies
+	if (util.GetEnvBool("PROXY_PROTOCOL", false) || util.GetEnvBool("TRUST_FORWARDED_FOR", false)) && os.Getenv("TRUSTED_PROXIES") == "" {
+		log.Fatal(errors.New("TRUSTED_PROXIES is required by PROXY_PROTOCOL and TRUST_FORWARDED_FOR"))
 	}
 
 	// DEBUG env indicates development mode, verbose log
@@ -46,18 +54,86 @@ func StartServer() {
 		addr = fmt.Sprintf("0.0.0.0:%s", os.Getenv("PORT"))
 	}
 
+	// plaintext mode serves WebSocket without TLS on its own address, for
+	// proxies which already terminate TLS like nginx and Envoy
+	plaintext := util.GetEnvBool("WS_PLAINTEXT", false)
+
+	// each transport can be disabled, and listens on its own addresses,
+	// like `0.0.0.0:8443,[::]:8443`
+	wsEnabled := util.GetEnvBool("WS_ENABLED", true)
+	wtEnabled := util.GetEnvBool("WT_ENABLED", true)
+	if !wsEnabled && !wtEnabled {
+		log.Fatal(errors.New("both WebSocket and WebTransport are disabled"))
+	}
+	wsDefault := addr
+	if plaintext {
+		wsDefault = "0.0.0.0:8080"
+		if v := os.Getenv("WS_PLAINTEXT_ADDR"); v != "" {
+			wsDefault = v
+		}
+	}
+	wsAddrs := listenAddrs("WS_ADDR", wsDefault)
+	wtAddrs := listenAddrs("WT_ADDR", addr)
+	adminAddrs := listenAddrs("ADMIN_ADDR", "")
+
 	// load TLS cert and key, halt if error occurs,
 	// this helped developers to find out TLS related issues asap.
-	config, err := loadTLS(os.Getenv("CERT_FILE"), os.Getenv("KEY_FILE"))
-	if err != nil {
-		log.Fatal(err)
+	var config *tls.Config
+	if (wsEnabled && !plaintext) || wtEnabled {
+		var err error
+		config, err = loadTLS(os.Getenv("CERT_FILE"), os.Getenv("KEY_FILE"))
+		if err != nil {
+			if !plaintext || !wsEnabled {
+				log.Fatal(err)
+			}
+			// WebTransport requires TLS, which is optional in plaintext mode
+			log.Error("WebTransport disabled", "err", err)
+			wtEnabled = false
+		}
 	}
 
-	// start WebSocket listener
-	go websocket.ListenAndServe(addr, config)
+	// mutual TLS for server-to-server clients, see chirp.AuthClientCertificate
+	if caFile := os.Getenv("MTLS_CA_FILE"); caFile != "" && config != nil {
+		if err := loadClientCAs(config, caFile, util.GetEnvBool("MTLS_REQUIRED", false)); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("mutual TLS enabled", "ca", caFile, "clientAuth", config.ClientAuth)
+	}
 
-	// start WebTransport listener
-	go webtransport.ListenAndServe(addr, config)
+	// admin listeners serve the endpoints for monitoring services, metrics
+	// are never exposed on public listeners
+	for _, a := range adminAddrs {
+		go serveAdmin(listenAdmin(a))
+	}
+	handler := newHTTPHandler()
+
+	// start WebSocket listeners, which also serve health check and the
+	// HTTP based fallback transports, and advertise HTTP/3 by Alt-Svc, all
+	// listeners are bound before ready
+	if wsEnabled {
+		wsHandler := handler
+		if wtEnabled {
+			wsHandler = withAltSvc(handler, wtAddrs[0])
+		}
+		wsConfig := config
+		if plaintext {
+			wsConfig = nil
+		}
+		for _, a := range wsAddrs {
+			go websocket.Serve(websocket.Listen(a, wsConfig), wsHandler)
+		}
+		if path := os.Getenv("WS_UNIX_SOCKET"); path != "" && plaintext {
+			go websocket.Serve(websocket.ListenUnix(path), wsHandler)
+		}
+	}
+
+	// start WebTransport listeners, which also serve plain HTTP/3 requests
+	if wtEnabled {
+		for _, a := range wtAddrs {
+			go webtransport.Serve(webtransport.Listen(a, config), handler)
+		}
+	}
+	ready.Store(true)
 
 	// Ctrl-C or kill <pid> graceful shutdown
 	// - `kill -SIGUSR1 <pid>` customize
@@ -82,6 +158,27 @@ func StartServer() {
 	registerSignal(c)
 }
 
+// listenAddrs returns the comma separated addresses in env key, or def if
+// empty, halt if any address is malformed.
+func listenAddrs(key, def string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		v = def
+	}
+	var addrs []string
+	for _, a := range strings.Split(v, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			log.Fatal(fmt.Errorf("%s: %w", key, err))
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs
+}
+
 func startYomoZipper() {
 	conf, err := config.ParseConfigFile("./yomo.yaml")
 	if err != nil {
@@ -0,0 +1,153 @@
+// Package sse serves the Server-Sent Events transport, for clients behind
+// proxies which kill both WebSocket and UDP. Client subscribes signalling by
+// an event stream and sends signalling by HTTP POST requests.
+package sse
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pilarjs/prscd/chirp"
+	"github.com/pilarjs/prscd/psig"
+	"github.com/pilarjs/prscd/util"
+)
+
+var log = util.Log
+
+const (
+	// SubscribePath is the path of event stream, `GET /v1/sse?id=xxx&publickey=xxx`
+	SubscribePath = chirp.Endpoint + "/sse"
+	// SendPath is the path to send signalling, `POST /v1/send` with the
+	// session token in `X-Prscd-Session` header or `session` query param.
+	SendPath = chirp.Endpoint + "/send"
+	// DurationOfPing describes the interval of comment lines sent to keep the stream alive
+	DurationOfPing = 10 * time.Second
+	// MaxSignalSize limits the size of the body of send requests
+	MaxSignalSize = 64 << 10
+)
+
+// sessions maps session token to *session
+var sessions sync.Map
+
+// session binds the event stream and send requests of a client.
+type session struct {
+	// mu serializes the signalling sent by concurrent requests, the peer
+	// handles signalling one by one like other transports do.
+	mu   sync.Mutex
+	peer *chirp.Peer
+}
+
+// HandleSubscribe serves the event stream. The first event is a `session`
+// event which carries the session token used to send signalling, followed by
+// `message` events each of which carries a signalling encoded in JSON.
+func HandleSubscribe(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	req, status, err := chirp.AuthConnectRequest(r.URL.Query(), r.Header.Get("Origin"), r.TLS)
+	if err != nil {
+		log.Error("sse.subscribe reject", "remoteAddr", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// now, the authorization is done, we can create realm instance by appID
+	node := chirp.GetOrCreateRealm(req.AppID, req.Credential)
+	if node == nil {
+		http.Error(w, "can not connect to yomo zipper", http.StatusServiceUnavailable)
+		return
+	}
+
+	token, err := util.NewSessionToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	// disable response buffering of nginx
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	pconn := chirp.NewSSEConnection(w, token, r.RemoteAddr)
+	defer pconn.Close()
+
+	// event stream is text, signalling is always encoded in JSON
+	peer := node.AddPeer(pconn, req.Cid)
+	peer.Version = req.Version
+	peer.Codec = psig.JSON
+	peer.CidVerified = req.CidVerified
+	log.Info("sse.subscribe", "sid", peer.Sid, "cid", peer.Cid, "appID", req.AppID)
+
+	sessions.Store(token, &session{peer: peer})
+	defer func() {
+		sessions.Delete(token)
+		peer.Disconnect()
+	}()
+
+	if err := pconn.WriteEvent("session", []byte(token)); err != nil {
+		log.Error("sse.write session error", "sid", peer.Sid, "err", err)
+		return
+	}
+
+	ticker := time.NewTicker(DurationOfPing)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Info("sse.unsubscribe", "sid", peer.Sid, "cid", peer.Cid)
+			return
+		case <-ticker.C:
+			// comment line keeps proxies from closing the idle stream
+			if _, err := pconn.RawWrite([]byte(": ping\n\n")); err != nil {
+				log.Error("sse.ping error", "sid", peer.Sid, "err", err)
+				return
+			}
+		}
+	}
+}
+
+// HandleSend receives a JSON encoded signalling from client and handles it
+// by the peer bound to the session token.
+func HandleSend(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.Header.Get("X-Prscd-Session")
+	if token == "" {
+		token = r.URL.Query().Get("session")
+	}
+	v, ok := sessions.Load(token)
+	if !ok {
+		http.Error(w, "session not found", http.StatusUnauthorized)
+		return
+	}
+	sess := v.(*session)
+
+	sess.mu.Lock()
+	err := sess.peer.HandleSignal(http.MaxBytesReader(w, r.Body, MaxSignalSize))
+	sess.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"os"
 	"time"
 )
 
@@ -34,3 +35,23 @@ func loadTLS(certFile, keyFile string) (*tls.Config, error) {
 		NextProtos:   []string{"http/1.1", "h2", "h3", "http/0.9", "http/1.0", "spdy/1", "spdy/2", "spdy/3"},
 	}, nil
 }
+
+// loadClientCAs enables mutual TLS on config, client certificates are
+// verified by the CA bundle in caFile. Clients without certificate, like
+// browsers, are still allowed unless required is true.
+func loadClientCAs(config *tls.Config, caFile string, required bool) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no CA certificate found in %s", caFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if required {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// GetEnvBool returns the boolean value of env `key`, or `def` if it is not
+// set or can not be parsed.
+func GetEnvBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// GetEnvInt returns the integer value of env `key`, or `def` if it is not
+// set or can not be parsed.
+func GetEnvInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// GetEnvDuration returns the duration value of env `key` like `10s`, or
+// `def` if it is not set or can not be parsed.
+func GetEnvDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedFor returns the address of client declared by `X-Forwarded-For`
+// header, used when TLS is terminated by a trusted proxy. The header is only
+// honoured if the direct peer is trusted, and the right-most address not of
+// trusted proxies is taken, as the left ones can be forged by the client.
+// It returns "" if the client address is not declared.
+//
+// The port of the direct peer is kept, so connections from the same client
+// still have different addresses.
+func ForwardedFor(r *http.Request, trusted TrustedProxies) string {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	// peers of Unix domain socket are local proxies, which are always trusted
+	if host != unixHost {
+		if ip := net.ParseIP(host); ip == nil || !trusted.Contains(ip) {
+			return ""
+		}
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			return ""
+		}
+		if i == 0 || !trusted.Contains(ip) {
+			return net.JoinHostPort(ip.String(), port)
+		}
+	}
+	return ""
+}
+
+// WithForwardedFor rewrites RemoteAddr of requests to the address of client
+// declared by `X-Forwarded-For` header.
+func WithForwardedFor(h http.Handler, trusted TrustedProxies) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addr := ForwardedFor(r, trusted); addr != "" {
+			r.RemoteAddr = addr
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,26 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// NewSessionToken returns a random token which is hard to guess, used to
+// bind the requests of HTTP based transports to a peer.
+func NewSessionToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// SetCORSHeaders allows browsers on other origins to request HTTP based transports.
+func SetCORSHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	h.Set("Access-Control-Allow-Headers", "Content-Type, X-Prscd-Session")
+	h.Set("Access-Control-Expose-Headers", "X-Prscd-Cursor, X-Prscd-Dropped")
+}
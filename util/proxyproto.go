@@ -0,0 +1,265 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TrustedProxies is a list of networks which are allowed to declare the
+// address of client, by PROXY protocol or `X-Forwarded-For` header.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma separated list of CIDRs or IPs, like
+// `10.0.0.0/8,192.168.1.1`.
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var nets TrustedProxies
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Contains tells if ip is trusted, no ip is trusted if the list is empty.
+func (t TrustedProxies) Contains(ip net.IP) bool {
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAddr tells if the host of addr is trusted.
+func (t TrustedProxies) containsAddr(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && t.Contains(ip)
+}
+
+// signatures of PROXY protocol, https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ErrProxyHeader is returned when reading from a connection with malformed PROXY protocol header.
+var ErrProxyHeader = errors.New("malformed PROXY protocol header")
+
+// NewProxyListener wraps ln to parse the PROXY protocol v1/v2 header sent by
+// trusted load balancers, RemoteAddr of accepted connections reports the
+// address of client declared by the header. Connections from untrusted
+// sources, or without header like health checks, are served as they are.
+//
+// The header is parsed on first Read or RemoteAddr call instead of Accept,
+// so slow clients do not block accepting others; timeout limits the time
+// to wait for it.
+func NewProxyListener(ln net.Listener, trusted TrustedProxies, timeout time.Duration) net.Listener {
+	return &proxyListener{Listener: ln, trusted: trusted, timeout: timeout}
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted TrustedProxies
+	timeout time.Duration
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted.containsAddr(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+// proxyConn is a connection from trusted load balancer.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of client declared by the PROXY protocol
+// header, or the address of load balancer if there is no header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// SyscallConn implements syscall.Conn if the underlying connection does.
+func (c *proxyConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errors.ErrUnsupported
+}
+
+// Buffered returns the bytes read from the underlying connection after the
+// header, which are not read by Read yet.
+func (c *proxyConn) Buffered() int {
+	c.once.Do(c.readHeader)
+	return c.r.Buffered()
+}
+
+func (c *proxyConn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+	c.remoteAddr, c.err = readProxyHeader(c.r)
+	if c.err != nil {
+		Log.Error("proxy protocol", "remoteAddr", c.Conn.RemoteAddr(), "err", c.err)
+		c.Conn.Close()
+	}
+}
+
+// readProxyHeader reads the PROXY protocol header if any, returns nil
+// address if there is no header, or the header does not declare a client
+// address like `PROXY UNKNOWN` and LOCAL command.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// the first byte tells if there is a header, TLS ClientHello starts with 0x16
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV1Signature[0]:
+		if sig, err := r.Peek(len(proxyV1Signature)); err == nil && bytes.Equal(sig, proxyV1Signature) {
+			return readProxyHeaderV1(r)
+		}
+	case proxyV2Signature[0]:
+		if sig, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+			return readProxyHeaderV2(r)
+		}
+	}
+	return nil, nil
+}
+
+// readProxyHeaderV1 reads the human-readable header like
+// `PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n`.
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// the header is at most 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads the binary header.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	verCmd, family := hdr[12], hdr[13]
+	length := binary.BigEndian.Uint16(hdr[14:16])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+	switch verCmd & 0x0f {
+	case 0x00: // LOCAL, e.g. health checks of load balancer
+		return nil, nil
+	case 0x01: // PROXY
+	default:
+		return nil, ErrProxyHeader
+	}
+
+	// address family and transport protocol, TLVs after addresses are ignored
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(payload) < 12 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(payload) < 36 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+	// UNSPEC or unix sockets
+	return nil, nil
+}
@@ -0,0 +1,165 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(verCmd, family byte, addrs []byte) []byte {
+		b := append([]byte{}, proxyV2Signature...)
+		b = append(b, verCmd, family)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+		return append(b, addrs...)
+	}
+	v4Addrs := []byte{10, 1, 2, 3, 192, 168, 0, 1, 0xdc, 0x04, 0x01, 0xbb}
+	v6Addrs := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x01, 0xbb)
+
+	tests := []struct {
+		name string
+		in   []byte
+		addr string // "" means no client address declared
+		err  bool
+	}{
+		{"no header", []byte("\x16\x03\x01hello"), "", false},
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\nhello"), "203.0.113.7:56324", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\nhello"), "[2001:db8::1]:12345", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\nhello"), "", false},
+		{"v1 malformed", []byte("PROXY TCP4 foo 10.0.0.1 1 443\r\nhello"), "", true},
+		{"v1 no crlf", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\nhello"), "", true},
+		{"v2 tcp4", append(v2(0x21, 0x11, v4Addrs), "hello"...), "10.1.2.3:56324", false},
+		{"v2 tcp6", append(v2(0x21, 0x21, v6Addrs), "hello"...), "[2001:db8::1]:12345", false},
+		{"v2 local", append(v2(0x20, 0x00, nil), "hello"...), "", false},
+		{"v2 tlvs", append(v2(0x21, 0x11, append(v4Addrs, 0x01, 0x00, 0x02, 'h', '2')), "hello"...), "10.1.2.3:56324", false},
+		{"v2 bad version", append(v2(0x11, 0x11, v4Addrs), "hello"...), "", true},
+		{"v2 short", append(v2(0x21, 0x11, v4Addrs[:8]), "hello"...), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tt.in))
+			addr, err := readProxyHeader(r)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got addr %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := addrString(addr); got != tt.addr {
+				t.Fatalf("expected addr %q, got %q", tt.addr, got)
+			}
+			// the bytes after header are kept
+			rest, _ := io.ReadAll(r)
+			if !bytes.HasSuffix(rest, []byte("hello")) {
+				t.Fatalf("unexpected rest bytes: %q", rest)
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestProxyListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	trusted, _ := ParseTrustedProxies("127.0.0.0/8")
+	pln := NewProxyListener(ln, trusted, 0)
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\nhello"))
+		c.Close()
+	}()
+
+	conn, err := pln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:56324" {
+		t.Fatalf("expected client address, got %s", got)
+	}
+	b, _ := io.ReadAll(conn)
+	if string(b) != "hello" {
+		t.Fatalf("unexpected payload: %q", b)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"2001:db8::1": true,
+		"203.0.113.7": false,
+	} {
+		if got := trusted.Contains(net.ParseIP(ip)); got != want {
+			t.Fatalf("Contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if empty, _ := ParseTrustedProxies(""); empty.Contains(net.ParseIP("10.1.2.3")) {
+		t.Fatal("empty list should trust nothing")
+	}
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Fatal("expected error of invalid CIDR")
+	}
+	if _, err := ParseTrustedProxies("foo"); err == nil {
+		t.Fatal("expected error of invalid IP")
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	trusted, _ := ParseTrustedProxies("10.0.0.0/8")
+	tests := []struct {
+		name       string
+		trusted    TrustedProxies
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"no header", trusted, "10.0.0.1:5000", nil, ""},
+		{"untrusted peer", trusted, "203.0.113.9:5000", []string{"203.0.113.7"}, ""},
+		{"single hop", trusted, "10.0.0.1:5000", []string{"203.0.113.7"}, "203.0.113.7:5000"},
+		{"forged hops", trusted, "10.0.0.1:5000", []string{"1.1.1.1, 203.0.113.7, 10.0.0.2"}, "203.0.113.7:5000"},
+		{"multiple headers", trusted, "10.0.0.1:5000", []string{"1.1.1.1", "203.0.113.7"}, "203.0.113.7:5000"},
+		{"all trusted", trusted, "10.0.0.1:5000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3:5000"},
+		{"malformed", trusted, "10.0.0.1:5000", []string{"foo"}, ""},
+		{"unix peer", trusted, "unix:3", []string{"203.0.113.7"}, "203.0.113.7:3"},
+		{"empty list", nil, "10.0.0.1:5000", []string{"1.1.1.1, 203.0.113.7"}, ""},
+		{"unix peer of empty list", nil, "unix:3", []string{"1.1.1.1, 203.0.113.7"}, "203.0.113.7:3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := ForwardedFor(r, tt.trusted); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
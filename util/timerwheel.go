@@ -0,0 +1,78 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// TimerWheel calls the functions added to it once per interval, which are
+// spread over the slots of the wheel, and the slots are visited one per tick
+// by a single goroutine, so it serves many connections without a timer for
+// each. Functions are called by that goroutine, they should not block.
+type TimerWheel struct {
+	mu    sync.Mutex
+	slots []map[*Timer]struct{}
+	cur   int
+}
+
+// Timer is a function added to TimerWheel.
+type Timer struct {
+	fn    func()
+	slot  int
+	wheel *TimerWheel
+}
+
+// NewTimerWheel creates a TimerWheel which visits a slot every tick, the
+// interval is rounded down to a multiple of tick.
+func NewTimerWheel(tick, interval time.Duration) *TimerWheel {
+	w := newTimerWheel(max(int(interval/tick), 1))
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for range ticker.C {
+			w.advance()
+		}
+	}()
+	return w
+}
+
+// newTimerWheel creates a TimerWheel of n slots, which is advanced by caller.
+func newTimerWheel(n int) *TimerWheel {
+	w := &TimerWheel{slots: make([]map[*Timer]struct{}, n)}
+	for i := range w.slots {
+		w.slots[i] = make(map[*Timer]struct{})
+	}
+	return w
+}
+
+// Add fn to the slot visited last, so it is called one interval later.
+func (w *TimerWheel) Add(fn func()) *Timer {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t := &Timer{fn: fn, slot: w.cur, wheel: w}
+	w.slots[t.slot][t] = struct{}{}
+	return t
+}
+
+// Stop removes the timer from its wheel, fn may still be called once if the
+// slot is being visited.
+func (t *Timer) Stop() {
+	t.wheel.mu.Lock()
+	defer t.wheel.mu.Unlock()
+	delete(t.wheel.slots[t.slot], t)
+}
+
+// advance to the next slot and call the functions in it.
+func (w *TimerWheel) advance() {
+	w.mu.Lock()
+	w.cur = (w.cur + 1) % len(w.slots)
+	due := make([]*Timer, 0, len(w.slots[w.cur]))
+	for t := range w.slots[w.cur] {
+		due = append(due, t)
+	}
+	w.mu.Unlock()
+
+	for _, t := range due {
+		t.fn()
+	}
+}
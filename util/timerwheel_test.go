@@ -0,0 +1,52 @@
+package util
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	w := newTimerWheel(5)
+	advance := func(n int) {
+		for range n {
+			w.advance()
+		}
+	}
+
+	var a, b int
+	ta := w.Add(func() { a++ })
+	advance(2)
+	w.Add(func() { b++ })
+
+	// fn is called once per interval, not before
+	advance(3)
+	if a != 1 || b != 0 {
+		t.Fatalf("expected a called once and b not yet, got %d %d", a, b)
+	}
+
+	ta.Stop()
+	advance(10)
+	if a != 1 {
+		t.Fatalf("stopped timer should not be called, got %d", a)
+	}
+	if b != 2 {
+		t.Fatalf("expected b called once per interval, got %d", b)
+	}
+}
+
+func TestTimerWheelTicks(t *testing.T) {
+	w := NewTimerWheel(time.Millisecond, 5*time.Millisecond)
+	called := make(chan struct{})
+	var once atomic.Bool
+	w.Add(func() {
+		if once.CompareAndSwap(false, true) {
+			close(called)
+		}
+	})
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("timer should be called by the ticks of wheel")
+	}
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+)
+
+// unixHost is the host of RemoteAddr of connections accepted by UnixListener.
+const unixHost = "unix"
+
+// NewUnixListener wraps the Unix domain socket listener ln. Peers of Unix
+// domain socket are unnamed, which makes RemoteAddr of all connections the
+// same, so accepted connections are numbered as `unix:<n>` instead, as the
+// Sid of peers is derived from it.
+func NewUnixListener(ln net.Listener) net.Listener {
+	return &unixListener{Listener: ln}
+}
+
+type unixListener struct {
+	net.Listener
+	seq atomic.Uint64
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.UnixAddr{
+		Name: net.JoinHostPort(unixHost, strconv.FormatUint(l.seq.Add(1), 10)),
+		Net:  "unix",
+	}
+	return &unixConn{Conn: conn, remoteAddr: addr}, nil
+}
+
+type unixConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// SyscallConn implements syscall.Conn if the underlying connection does.
+func (c *unixConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prscd.sock")
+	lu, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewUnixListener(lu)
+	defer ln.Close()
+
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		seen[conn.RemoteAddr().String()] = true
+	}
+	if !seen["unix:1"] || !seen["unix:2"] {
+		t.Fatalf("expected numbered addresses, got %v", seen)
+	}
+}
@@ -0,0 +1,79 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws/wsflate"
+
+	"github.com/pilarjs/prscd/chirp"
+	"github.com/pilarjs/prscd/util"
+)
+
+// deflateOptions loads permessage-deflate settings from env, returns false
+// if compression is disabled, or error if settings are illegal:
+//   - WS_DEFLATE: enable permessage-deflate, default false
+//   - WS_DEFLATE_THRESHOLD: messages smaller than this are not compressed, default 256 bytes
+//   - WS_DEFLATE_LEVEL: compression level -2 (huffman only) to 9, default 1 (best speed)
+//   - WS_DEFLATE_SERVER_NO_CONTEXT_TAKEOVER: reset server compressor per message, default false
+//   - WS_DEFLATE_CLIENT_NO_CONTEXT_TAKEOVER: ask client to reset its compressor per message, default false
+//   - WS_DEFLATE_MAX_MESSAGE: max size of decompressed message, default 1MB
+func deflateOptions() (chirp.DeflateOptions, bool, error) {
+	if !util.GetEnvBool("WS_DEFLATE", false) {
+		return chirp.DeflateOptions{}, false, nil
+	}
+	opts := chirp.DeflateOptions{
+		Threshold:               util.GetEnvInt("WS_DEFLATE_THRESHOLD", 256),
+		Level:                   util.GetEnvInt("WS_DEFLATE_LEVEL", flate.BestSpeed),
+		ServerNoContextTakeover: util.GetEnvBool("WS_DEFLATE_SERVER_NO_CONTEXT_TAKEOVER", false),
+		ClientNoContextTakeover: util.GetEnvBool("WS_DEFLATE_CLIENT_NO_CONTEXT_TAKEOVER", false),
+		MaxMessageSize:          int64(util.GetEnvInt("WS_DEFLATE_MAX_MESSAGE", 1<<20)),
+	}
+	if opts.Level < flate.HuffmanOnly || opts.Level > flate.BestCompression {
+		return opts, false, fmt.Errorf("WS_DEFLATE_LEVEL should be in [%d, %d], got %d", flate.HuffmanOnly, flate.BestCompression, opts.Level)
+	}
+	return opts, true, nil
+}
+
+// deflateNegotiator negotiates permessage-deflate extension in the WebSocket
+// handshake of one connection, https://www.rfc-editor.org/rfc/rfc7692#section-5.
+type deflateNegotiator struct {
+	opts     chirp.DeflateOptions
+	params   wsflate.Parameters
+	accepted bool
+}
+
+// Negotiate implements ws.Upgrader.Negotiate, accepts the first offer which
+// can be served. Offers restricting the server window are declined because
+// compress/flate always uses a 32KB window.
+func (n *deflateNegotiator) Negotiate(opt httphead.Option) (httphead.Option, error) {
+	if n.accepted || !bytes.Equal(opt.Name, wsflate.ExtensionNameBytes) {
+		return httphead.Option{}, nil
+	}
+	var offer wsflate.Parameters
+	if err := offer.Parse(opt); err != nil {
+		// malformed offer, decline it but do not fail the handshake
+		log.Debug("ws.deflate illegal offer", "err", err)
+		return httphead.Option{}, nil
+	}
+	if offer.ServerMaxWindowBits.Defined() && offer.ServerMaxWindowBits < 15 {
+		return httphead.Option{}, nil
+	}
+
+	n.params = wsflate.Parameters{
+		ServerNoContextTakeover: offer.ServerNoContextTakeover || n.opts.ServerNoContextTakeover,
+		ClientNoContextTakeover: offer.ClientNoContextTakeover || n.opts.ClientNoContextTakeover,
+	}
+	n.accepted = true
+	return n.params.Option(), nil
+}
+
+// Deflate returns the compressor of the connection, nil if not negotiated.
+func (n *deflateNegotiator) Deflate() *chirp.Deflate {
+	if n == nil || !n.accepted {
+		return nil
+	}
+	return chirp.NewDeflate(n.params, n.opts)
+}
@@ -0,0 +1,14 @@
+package websocket
+
+import "testing"
+
+func TestDeflateOptionsLevel(t *testing.T) {
+	t.Setenv("WS_DEFLATE", "true")
+	for level, legal := range map[string]bool{"-2": true, "1": true, "9": true, "-3": false, "10": false} {
+		t.Setenv("WS_DEFLATE_LEVEL", level)
+		_, enabled, err := deflateOptions()
+		if legal != (err == nil) || enabled != legal {
+			t.Fatalf("level %s: legal should be %v, got enabled=%v err=%v", level, legal, enabled, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package websocket
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	"github.com/pilarjs/prscd/chirp"
+	"github.com/pilarjs/prscd/util"
+)
+
+// keepaliveOptions describes the pings of WebSocket connections.
+type keepaliveOptions struct {
+	PingInterval time.Duration // interval of ping
+	PongTimeout  time.Duration // max duration without frames from peer, 0 means no limit
+}
+
+// loadKeepaliveOptions loads the options from env:
+//   - WS_PING_INTERVAL: interval of ping, default 10s
+//   - WS_PONG_TIMEOUT: peers sending no frame, pongs included, for this
+//     duration are disconnected, default 30s, 0 disables it
+func loadKeepaliveOptions() keepaliveOptions {
+	opts := keepaliveOptions{
+		PingInterval: util.GetEnvDuration("WS_PING_INTERVAL", DurationOfPing),
+		PongTimeout:  util.GetEnvDuration("WS_PONG_TIMEOUT", 3*DurationOfPing),
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = DurationOfPing
+	}
+	return opts
+}
+
+// keepalive is loaded after .env, and shared by all WebSocket connections.
+var keepalive = sync.OnceValue(func() *keeper {
+	opts := loadKeepaliveOptions()
+	log.Info("ws.keepalive", "options", opts)
+	return newKeeper(opts, 4*runtime.NumCPU())
+})
+
+// keeper pings WebSocket connections by a single timer wheel instead of a
+// ticker per connection, and closes those whose peer stops answering. Pings
+// are written by a pool of workers, as writes may block on slow peers.
+type keeper struct {
+	opts  keepaliveOptions
+	wheel *util.TimerWheel
+	jobs  chan func()
+}
+
+func newKeeper(opts keepaliveOptions, workers int) *keeper {
+	k := &keeper{
+		opts:  opts,
+		wheel: util.NewTimerWheel(min(time.Second, opts.PingInterval), opts.PingInterval),
+		jobs:  make(chan func(), workers),
+	}
+	for range workers {
+		go func() {
+			for job := range k.jobs {
+				job()
+			}
+		}()
+	}
+	return k
+}
+
+// keepaliveConn is a WebSocket connection pinged by keeper.
+type keepaliveConn struct {
+	conn     net.Conn
+	pconn    chirp.Connection
+	sid      string
+	expire   func()       // closes the connection of dead peer
+	lastSeen atomic.Int64 // unix nano of the last frame received
+	expired  atomic.Bool
+	timer    *util.Timer
+}
+
+// add starts pinging the connection, expire is called once if the peer
+// sends nothing for PongTimeout, the connection should be closed by it so
+// the peer is disconnected by its reader.
+func (k *keeper) add(conn net.Conn, pconn chirp.Connection, sid string, expire func()) *keepaliveConn {
+	kc := &keepaliveConn{conn: conn, pconn: pconn, sid: sid, expire: expire}
+	kc.touch()
+	kc.timer = k.wheel.Add(func() { k.check(kc) })
+	return kc
+}
+
+// check is called by the timer wheel once per ping interval, it never
+// blocks the wheel on busy workers.
+func (k *keeper) check(kc *keepaliveConn) {
+	if k.opts.PongTimeout > 0 && time.Since(time.Unix(0, kc.lastSeen.Load())) > k.opts.PongTimeout {
+		// the timer is stopped by the owner of connection once it is closed
+		if kc.expired.CompareAndSwap(false, true) {
+			connStats.Add("pong_timeout", 1)
+			log.Info("ws.keepalive pong timeout", "sid", kc.sid, "timeout", k.opts.PongTimeout)
+			select {
+			case k.jobs <- kc.expire:
+			default:
+				// expire is called only once, so it is never dropped
+				go kc.expire()
+			}
+		}
+		return
+	}
+	select {
+	case k.jobs <- func() { k.ping(kc) }:
+	default:
+		// workers are held by slow peers, ping again in next interval
+		connStats.Add("ping_dropped", 1)
+	}
+}
+
+func (k *keeper) ping(kc *keepaliveConn) {
+	// bound the write, so peers which stop reading can not hold the workers
+	kc.conn.SetWriteDeadline(time.Now().Add(k.opts.PingInterval))
+	defer kc.conn.SetWriteDeadline(time.Time{})
+	if _, err := kc.pconn.RawWrite(generatePingFrame()); err != nil {
+		log.Debug("ws.keepalive ping error", "sid", kc.sid, "err", err)
+	}
+}
+
+// touch records a frame received from peer.
+func (kc *keepaliveConn) touch() {
+	kc.lastSeen.Store(time.Now().UnixNano())
+}
+
+// stop pinging the connection.
+func (kc *keepaliveConn) stop() {
+	kc.timer.Stop()
+}
+
+// writeGoingAway sends Close frame to the dead peer, without waiting long
+// for peers which stop reading, no frame can be written after it.
+func writeGoingAway(conn net.Conn, pconn chirp.Connection, reason string) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	pconn.RawWrite(ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusGoingAway, reason))))
+	conn.SetWriteDeadline(time.Now())
+}
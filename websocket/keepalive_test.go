@@ -0,0 +1,95 @@
+package websocket
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	"github.com/pilarjs/prscd/chirp"
+)
+
+func TestKeeper(t *testing.T) {
+	k := newKeeper(keepaliveOptions{PingInterval: 20 * time.Millisecond, PongTimeout: 70 * time.Millisecond}, 2)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	expired := make(chan struct{})
+	kc := k.add(server, chirp.NewWebSocketConnection(server, chirp.WebSocketOptions{}), "sid", func() {
+		close(expired)
+	})
+	defer kc.stop()
+
+	// peer answering pings is kept alive
+	for range 5 {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		h, err := ws.ReadHeader(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.OpCode != ws.OpPing {
+			t.Fatalf("expected ping, got %v", h.OpCode)
+		}
+		if _, err := client.Read(make([]byte, h.Length)); err != nil {
+			t.Fatal(err)
+		}
+		kc.touch()
+	}
+	select {
+	case <-expired:
+		t.Fatal("peer answering pings should not expire")
+	default:
+	}
+
+	// peer stops answering, pings are still read so writes do not block
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			if _, err := client.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("silent peer should expire")
+	}
+}
+
+func TestKeeperBusyWorkers(t *testing.T) {
+	k := newKeeper(keepaliveOptions{PingInterval: time.Hour, PongTimeout: time.Minute}, 1)
+
+	// the worker and the queue are held by a slow peer
+	block := make(chan struct{})
+	defer close(block)
+	k.jobs <- func() { <-block }
+	k.jobs <- func() { <-block }
+
+	server, client := net.Pipe()
+	defer client.Close()
+	expired := make(chan struct{})
+	kc := k.add(server, chirp.NewWebSocketConnection(server, chirp.WebSocketOptions{}), "sid", func() {
+		close(expired)
+	})
+	defer kc.stop()
+
+	checked := make(chan struct{})
+	go func() {
+		k.check(kc)
+		kc.lastSeen.Store(time.Now().Add(-time.Hour).UnixNano())
+		k.check(kc)
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(time.Second):
+		t.Fatal("check should not block on busy workers")
+	}
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("dead peer should expire even if workers are busy")
+	}
+}
@@ -0,0 +1,271 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pilarjs/prscd/util"
+)
+
+// limitOptions describes the limits of connections accepted by WebSocket
+// listeners, shared by all the listeners of the process.
+type limitOptions struct {
+	MaxConns         int           // max connections, 0 means no limit
+	MaxConnsPerIP    int           // max connections per client IP, 0 means no limit
+	MaxHandshakes    int           // max concurrent handshakes
+	HandshakeTimeout time.Duration // max duration of TLS handshake and WebSocket upgrade request
+}
+
+// loadLimitOptions loads the limits from env:
+//   - WS_MAX_CONNS: max connections, default 0 (no limit)
+//   - WS_MAX_CONNS_PER_IP: max connections per client IP, default 0 (no limit)
+//   - WS_MAX_HANDSHAKES: max concurrent handshakes, default 256
+//   - WS_HANDSHAKE_TIMEOUT: max duration of handshake, default 10s
+func loadLimitOptions() limitOptions {
+	opts := limitOptions{
+		MaxConns:         util.GetEnvInt("WS_MAX_CONNS", 0),
+		MaxConnsPerIP:    util.GetEnvInt("WS_MAX_CONNS_PER_IP", 0),
+		MaxHandshakes:    util.GetEnvInt("WS_MAX_HANDSHAKES", 256),
+		HandshakeTimeout: util.GetEnvDuration("WS_HANDSHAKE_TIMEOUT", 10*time.Second),
+	}
+	if opts.MaxHandshakes < 1 {
+		opts.MaxHandshakes = 1
+	}
+	return opts
+}
+
+// connLimiter is loaded after .env, and shared by all WebSocket listeners.
+var connLimiter = sync.OnceValue(func() *limiter {
+	return newLimiter(loadLimitOptions())
+})
+
+// connStats are the counters of connections, published as `ws_conns` expvar.
+var connStats = expvar.NewMap("ws_conns")
+
+// limiter tracks the connections and the handshakes in progress.
+type limiter struct {
+	opts       limitOptions
+	handshakes chan struct{} // semaphore of concurrent handshakes
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newLimiter(opts limitOptions) *limiter {
+	l := &limiter{
+		opts:       opts,
+		handshakes: make(chan struct{}, opts.MaxHandshakes),
+		perIP:      make(map[string]int),
+	}
+	connStats.Set("active", expvar.Func(func() any {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.total
+	}))
+	connStats.Set("handshaking", expvar.Func(func() any {
+		return len(l.handshakes)
+	}))
+	return l
+}
+
+// acquire reserves a connection and a handshake slot for a new connection,
+// returns false if any limit is reached.
+func (l *limiter) acquire() bool {
+	select {
+	case l.handshakes <- struct{}{}:
+	default:
+		connStats.Add("rejected_max_handshakes", 1)
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.opts.MaxConns > 0 && l.total >= l.opts.MaxConns {
+		<-l.handshakes
+		connStats.Add("rejected_max_conns", 1)
+		return false
+	}
+	l.total++
+	return true
+}
+
+// acquireIP reserves a connection of the client at addr once its address
+// is known, which may be declared by PROXY protocol header, returns the key
+// to release it. Connections of Unix domain socket are not limited per IP.
+func (l *limiter) acquireIP(addr net.Addr) (key string, ok bool) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || l.opts.MaxConnsPerIP <= 0 || net.ParseIP(host) == nil {
+		return "", true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perIP[host] >= l.opts.MaxConnsPerIP {
+		connStats.Add("rejected_max_conns_per_ip", 1)
+		return "", false
+	}
+	l.perIP[host]++
+	return host, true
+}
+
+// handshakeDone releases the handshake slot.
+func (l *limiter) handshakeDone() {
+	<-l.handshakes
+}
+
+// release the connection when it is closed, or rejected, key is returned
+// by acquireIP.
+func (l *limiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if key == "" {
+		return
+	}
+	if l.perIP[key]--; l.perIP[key] <= 0 {
+		delete(l.perIP, key)
+	}
+}
+
+// handshakeListener accepts connections in its own goroutine, and performs
+// the handshakes, reading PROXY protocol header and TLS handshake, in one
+// goroutine per connection, so slow clients do not stall the accept loop.
+// Accept returns connections ready to read the WebSocket upgrade request.
+type handshakeListener struct {
+	net.Listener
+	config  *tls.Config // nil in plaintext mode
+	limiter *limiter
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newHandshakeListener(ln net.Listener, config *tls.Config, limiter *limiter) *handshakeListener {
+	l := &handshakeListener{
+		Listener: ln,
+		config:   config,
+		limiter:  limiter,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *handshakeListener) acceptLoop() {
+	var backoff time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.close()
+				return
+			}
+			// like net/http, retry on errors such as too many open files
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			log.Error("ws.accept error, retrying", "err", err, "backoff", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		if !l.limiter.acquire() {
+			// the address of client is not logged, it may be declared by a
+			// PROXY protocol header not read yet, which would block accepting
+			log.Debug("ws.accept reject", "listener", l.Addr(), "reason", "max handshakes")
+			conn.Close()
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *handshakeListener) handshake(conn net.Conn) {
+	defer l.limiter.handshakeDone()
+
+	// the address of client may be declared by PROXY protocol header, which
+	// is read with its own timeout
+	key, ok := l.limiter.acquireIP(conn.RemoteAddr())
+	if !ok {
+		log.Debug("ws.handshake reject", "remoteAddr", conn.RemoteAddr(), "reason", "max connections per ip")
+		l.limiter.release("")
+		conn.Close()
+		return
+	}
+	var c net.Conn = &limitedConn{Conn: conn, release: func() { l.limiter.release(key) }}
+
+	if l.config != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), l.limiter.opts.HandshakeTimeout)
+		defer cancel()
+		tc := tls.Server(c, l.config)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			connStats.Add("handshake_failed", 1)
+			log.Debug("ws.handshake error", "remoteAddr", conn.RemoteAddr(), "err", err)
+			tc.Close()
+			return
+		}
+		c = tc
+	}
+
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// Accept returns the next connection which finished handshake.
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the accept loop, connections in handshake are closed.
+func (l *handshakeListener) Close() error {
+	err := l.Listener.Close()
+	l.close()
+	return err
+}
+
+func (l *handshakeListener) close() {
+	l.closeOnce.Do(func() { close(l.done) })
+}
+
+// limitedConn releases its reservation of limiter when closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// SyscallConn implements syscall.Conn if the wrapped connection does, used
+// by the reactor.
+func (c *limitedConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errors.ErrUnsupported
+}
+
+// Buffered returns the bytes buffered by the wrapped connection.
+func (c *limitedConn) Buffered() int {
+	if b, ok := c.Conn.(interface{ Buffered() int }); ok {
+		return b.Buffered()
+	}
+	return 0
+}
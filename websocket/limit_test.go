@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+)
+
+// statOf returns the counter of connStats, 0 if not counted yet.
+func statOf(name string) int64 {
+	if v, ok := connStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestHandshakeListener(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter(limitOptions{MaxConns: 2, MaxConnsPerIP: 1, MaxHandshakes: 4, HandshakeTimeout: time.Second})
+	ln := newHandshakeListener(raw, nil, l)
+	defer ln.Close()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", raw.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c1 := dial()
+	defer c1.Close()
+	s1, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second connection from the same ip is rejected
+	rejected := statOf("rejected_max_conns_per_ip")
+	c2 := dial()
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err == nil {
+		t.Fatal("second connection from the same ip should be closed")
+	}
+	if n := statOf("rejected_max_conns_per_ip") - rejected; n != 1 {
+		t.Fatalf("rejection should be counted, got %d", n)
+	}
+
+	// the reservation is released when the connection is closed
+	s1.Close()
+	c3 := dial()
+	defer c3.Close()
+	s3, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3.Close()
+
+	l.mu.Lock()
+	total := l.total
+	l.mu.Unlock()
+	if total != 1 {
+		t.Fatalf("expected 1 active connection, got %d", total)
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("accept should fail after close")
+	}
+}
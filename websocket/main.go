@@ -2,22 +2,25 @@
 package websocket
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/gobwas/httphead"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 
 	"github.com/pilarjs/prscd/chirp"
+	"github.com/pilarjs/prscd/psig"
 	"github.com/pilarjs/prscd/util"
 )
 
@@ -28,245 +31,363 @@ const (
 	DurationOfPing = 10 * time.Second
 )
 
-// ListenAndServe create the websocket server
-func ListenAndServe(addr string, config *tls.Config) {
+// ListenAndServe create the websocket server, HTTP requests other than
+// WebSocket upgrade to chirp.Endpoint are served by handler. Connections are
+// served in plaintext if config is nil, like behind a TLS-terminating proxy.
+func ListenAndServe(addr string, config *tls.Config, handler http.Handler) {
+	Serve(Listen(addr, config), handler)
+}
+
+// Listen binds the TCP listener of the websocket server on addr, halt if
+// error occurs, the listener is served by Serve.
+func Listen(addr string, config *tls.Config) net.Listener {
 	// create TCP listener
 	lp, err := lc.Listen(context.Background(), "tcp", addr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer lp.Close()
 
-	// wrap TCP listener with TLS
-	ln := tls.NewListener(lp, config)
+	// behind L4 load balancers, the address of client is declared by PROXY
+	// protocol header before TLS handshake
+	if util.GetEnvBool("PROXY_PROTOCOL", false) {
+		lp = util.NewProxyListener(lp, trustedProxies(), 10*time.Second)
+		log.Info("proxy protocol enabled", "trusted", os.Getenv("TRUSTED_PROXIES"))
+	}
+
+	// TLS handshakes are performed off the accept loop
+	ln := newHandshakeListener(lp, config, connLimiter())
+
+	log.Info("prscd start WebSocket Server", "addr", ln.Addr(), "tls", config != nil)
+	return ln
+}
+
+// ListenAndServeUnix create the websocket server on the Unix domain socket
+// at path in plaintext, for proxies on the same host.
+func ListenAndServeUnix(path string, handler http.Handler) {
+	Serve(ListenUnix(path), handler)
+}
+
+// ListenUnix binds the Unix domain socket at path, halt if error occurs.
+func ListenUnix(path string) net.Listener {
+	// remove the socket file left by last run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	lu, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln := newHandshakeListener(util.NewUnixListener(lu), nil, connLimiter())
+
+	log.Info("prscd start WebSocket Server", "unix", path)
+	return ln
+}
+
+// Serve serves HTTP requests accepted by ln until it is closed.
+func Serve(ln net.Listener, handler http.Handler) {
 	defer ln.Close()
 
-	log.Info("prscd start WebSocket Server", "addr", ln.Addr())
+	// permessage-deflate settings
+	deflateOpts, deflateEnabled, err := deflateOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Info("ws.deflate", "enabled", deflateEnabled, "options", deflateOpts)
+	log.Info("ws.limits", "options", connLimiter().opts)
 
-	// var node = chirp.Node
+	var h http.Handler = &server{
+		handler:        handler,
+		deflateOpts:    deflateOpts,
+		deflateEnabled: deflateEnabled,
+	}
+	// honour `X-Forwarded-For` when TLS is terminated by trusted proxies
+	if util.GetEnvBool("TRUST_FORWARDED_FOR", false) {
+		h = util.WithForwardedFor(h, trustedProxies())
+		log.Info("X-Forwarded-For enabled", "trusted", os.Getenv("TRUSTED_PROXIES"))
+	}
 
-	for {
-		// TCP has new connection
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Error("ln.accept error", "err", err)
-			conn.Close()
-			continue
-		}
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: connLimiter().opts.HandshakeTimeout,
+		// WebSocket upgrade hijacks the HTTP/1.1 connection, disable HTTP/2
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+
+	if err := srv.Serve(ln); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// trustedProxies returns the sources allowed to declare the address of
+// client, halt if the `TRUSTED_PROXIES` env is malformed.
+func trustedProxies() util.TrustedProxies {
+	trusted, err := util.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return trusted
+}
 
-		var cuid, appID, credential string // Pilar.js client user id
-
-		rejectionHeader := ws.RejectionHeader(ws.HandshakeHeaderString("X-Prscd-Version: v2\r\nX-Prscd-MeshID: " + os.Getenv("MESH_ID") + "\r\n"))
-
-		// HTTP layer
-		u := ws.Upgrader{
-			OnRequest: func(req []byte) error {
-				// the request url should be like: /v1?id=xxx&publickey=xxx
-				url, err := url.ParseRequestURI(string(req))
-				if err != nil {
-					log.Error("url parse error: %s", err)
-					return ws.RejectConnectionError(
-						ws.RejectionStatus(500),
-						rejectionHeader,
-						ws.RejectionReason("url parse error"),
-					)
-				}
-				log.Debug("ws upgrade", "path", url.Path, "query", url.Query())
-
-				// Health check endpoint for monitoring services (Datadog, etc.)
-				if url.Path == "/health" {
-					resString := `{"status":"healthy","service":"prscd"}`
-					conn.Write([]byte("HTTP/1.1 200 OK\r\n" +
-						"Content-Type: application/json\r\n" +
-						"X-Prscd-Version: v2.1.1\r\n" +
-						"X-Prscd-MeshID: " + os.Getenv("MESH_ID") + "\r\n" +
-						"Content-Length: " + fmt.Sprintf("%d", len(resString)) + "\r\n" +
-						"\r\n" +
-						resString))
-					conn.Close()
-					return errors.New("health check handled")
-				}
-
-				if url.Path != chirp.Endpoint {
-					return ws.RejectConnectionError(
-						ws.RejectionStatus(404),
-						rejectionHeader,
-						ws.RejectionReason("path not allowed"),
-					)
-				}
-				cuid = url.Query().Get("id")
-				if cuid == "" {
-					return ws.RejectConnectionError(
-						ws.RejectionStatus(401),
-						rejectionHeader,
-						ws.RejectionReason("id must not be empty"),
-					)
-				}
-				// publickey can be used for identify user if developer want integrate with other systems
-				authPublicKey := url.Query().Get("publickey")
-				if authPublicKey == "" {
-					return ws.RejectConnectionError(
-						ws.RejectionStatus(401),
-						rejectionHeader,
-						ws.RejectionReason("publickey must not be empty"),
-					)
-				}
-				var ok bool
-				appID, credential, ok = chirp.AuthUserAndGetYoMoCredential(authPublicKey)
-				if !ok {
-					return ws.RejectConnectionError(
-						ws.RejectionStatus(403),
-						rejectionHeader,
-						ws.RejectionReason("illegal public key"),
-					)
-				}
-				log.Info("ws.upgrade", "queryId", cuid, "appID", appID)
-				return nil
-			},
-			OnHeader: func(key, value []byte) error {
-				// implement this method to check request headers if needed
-				// log.Info("header: %s=%s", string(key), string(value))
-				return nil
-			},
-			OnBeforeUpgrade: func() (ws.HandshakeHeader, error) {
-				// before upgrade to websocket, logic can be implemented here
-				return ws.HandshakeHeaderHTTP(http.Header{
-					"X-Prscd-VER":    []string{"v2.1.1"},
-					"X-Prscd-MESHID": []string{os.Getenv("MESH_ID")},
-				}), nil
-			},
+// server upgrades requests to chirp.Endpoint to WebSocket.
+type server struct {
+	handler        http.Handler
+	deflateOpts    chirp.DeflateOptions
+	deflateEnabled bool
+}
+
+// isUpgradeRequest tells if r asks for upgrading to WebSocket.
+func isUpgradeRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// ServeHTTP implements http.Handler.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// only WebSocket upgrade requests to chirp.Endpoint are upgraded, others
+	// are routed by handler
+	if r.URL.Path != chirp.Endpoint || !isUpgradeRequest(r) {
+		if s.handler == nil {
+			http.NotFound(w, r)
+			return
 		}
+		s.handler.ServeHTTP(w, r)
+		return
+	}
 
-		// zero-copy reuse the TCP connection
-		p, err := u.Upgrade(conn)
+	w.Header().Set("X-Prscd-Version", "v2")
+	w.Header().Set("X-Prscd-MeshID", os.Getenv("MESH_ID"))
+	w.Header().Set("X-Prscd-Protocols", psig.SupportedVersionsString())
+
+	// the request url should be like: /v1?id=xxx&publickey=xxx
+	log.Debug("ws upgrade", "path", r.URL.Path, "query", r.URL.Query())
+	req, status, err := chirp.AuthConnectRequest(r.URL.Query(), r.Header.Get("Origin"), r.TLS)
+	if err != nil {
+		log.Error("ws.upgrade reject", "remoteAddr", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// protocol version can also be declared by `Sec-WebSocket-Protocol`
+	// header, which takes precedence over the `v` query param
+	codec := psig.Msgpack
+	protocol := ""
+	if values := r.Header.Values("Sec-WebSocket-Protocol"); len(values) > 0 {
+		p, v, c, err := selectSubprotocol(strings.Join(values, ","))
 		if err != nil {
-			if err == io.EOF {
-				log.Inspect("connection closed by peer.", "remoteAddr", conn.RemoteAddr().String())
-			} else {
-				log.Info("[ws] new conn", "remoteAddr", conn.RemoteAddr().String())
-				// if is rejected connection error, send close frame to client
-				var rejectErr *ws.ConnectionRejectedError
-				if errors.As(err, &rejectErr) {
-					ws.WriteFrame(conn, ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusCode(rejectErr.StatusCode()), rejectErr.Error())))
-					log.Error("u.upgrade reject error, close connection", "remoteAddr", conn.RemoteAddr().String(), "err", err)
-				} else {
-					log.Error("u.upgrade unknown error, close connection", "remoteAddr", conn.RemoteAddr().String(), "err", err)
-				}
+			log.Error("ws.upgrade reject", "remoteAddr", r.RemoteAddr, "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if p != "" {
+			protocol = p
+			req.Version = v
+			codec = c
+		}
+	}
+
+	var negotiator *deflateNegotiator // permessage-deflate negotiation
+	if s.deflateEnabled {
+		negotiator = &deflateNegotiator{opts: s.deflateOpts}
+	}
+
+	u := ws.HTTPUpgrader{
+		Header: http.Header{
+			"X-Prscd-VER":      []string{"v2.1.1"},
+			"X-Prscd-MESHID":   []string{os.Getenv("MESH_ID")},
+			"X-Prscd-PROTOCOL": []string{string(req.Version)},
+		},
+		Protocol: func(p string) bool {
+			return p == protocol
+		},
+		Negotiate: func(opt httphead.Option) (httphead.Option, error) {
+			if negotiator == nil {
+				return httphead.Option{}, nil
 			}
+			return negotiator.Negotiate(opt)
+		},
+	}
 
-			conn.Write(ws.CompiledClose)
+	// zero-copy reuse the TCP connection
+	conn, rw, hs, err := u.Upgrade(r, w)
+	if err != nil {
+		log.Error("u.upgrade error, close connection", "remoteAddr", r.RemoteAddr, "err", err)
+		if conn != nil {
 			conn.Close()
-			continue
 		}
+		return
+	}
 
-		log.Info("upgrade success, start serving", "remoteAddr", conn.RemoteAddr().String(), "handshake", p)
+	log.Info("upgrade success, start serving", "remoteAddr", r.RemoteAddr, "queryId", req.Cid, "appID", req.AppID, "handshake", hs)
 
-		// now, the authorization is done, we can create realm instance by appID
-		node := chirp.GetOrCreateRealm(appID, credential)
+	serve(conn, rw, req, chirp.WebSocketOptions{
+		Text:       codec.Text(),
+		Deflate:    negotiator.Deflate(),
+		RemoteAddr: r.RemoteAddr,
+	}, codec)
+}
 
-		// if can not connect to yomo zipper, close connection
-		if node == nil {
-			conn.Close()
+// serve the upgraded WebSocket connection until it is closed.
+func serve(conn net.Conn, rw *bufio.ReadWriter, req *chirp.ConnectRequest, opts chirp.WebSocketOptions, codec psig.Codec) {
+	// now, the authorization is done, we can create realm instance by appID
+	node := chirp.GetOrCreateRealm(req.AppID, req.Credential)
+
+	// if can not connect to yomo zipper, close connection
+	if node == nil {
+		conn.Close()
+		return
+	}
+
+	// create peer instance after Websocket handshake
+	pconn := chirp.NewWebSocketConnection(conn, opts)
+	peer := node.AddPeer(pconn, req.Cid)
+	peer.Version = req.Version
+	peer.Codec = codec
+	peer.CidVerified = req.CidVerified
+	log.Debug("Upgrade done!", "sid", peer.Sid, "cid", peer.Cid, "version", peer.Version, "codec", peer.Codec.Name())
+
+	// RSV1 bit is only allowed when permessage-deflate negotiated
+	state := ws.StateServerSide
+	if opts.Deflate != nil {
+		state |= ws.StateExtended
+	}
+
+	// park the connection in the epoll reactor if enabled, frames buffered
+	// in the reader of hijacked HTTP connection are not seen by epoll, so
+	// those connections are served by goroutines
+	if r := wsReactor(); r != nil && rw.Reader.Buffered() == 0 {
+		err := r.register(&reactorConn{conn: conn, pconn: pconn, peer: peer, state: state, deflate: opts.Deflate})
+		if err == nil {
 			return
 		}
+		connStats.Add("reactor_fallback", 1)
+		log.Debug("ws.reactor fallback", "sid", peer.Sid, "err", err)
+	}
 
-		// create peer instance after Websocket handshake
-		pconn := chirp.NewWebSocketConnection(conn)
-		peer := node.AddPeer(pconn, cuid)
-		log.Debug("Upgrade done!", "sid", peer.Sid, "cid", peer.Cid)
-
-		keepaliveDone := make(chan bool)
-		go func(c net.Conn) {
-			// according to https://tools.ietf.org/html/rfc6455#section-5.5.2, Web Browsers will not send Ping frame,
-			// backend server should send Ping frame to keep connection alive, and Web Browsers will auto reply Pong frame when receive Ping frame. But in Chrome DevTools, Ping/Pong frame is not shown.
-			ticker := time.NewTicker(DurationOfPing)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-keepaliveDone:
-					log.Debug("ticker done", "sid", peer.Sid)
-					return
-				case <-ticker.C:
-					// c.Write(generatePingFrame())
-					pconn.RawWrite(generatePingFrame())
-				}
-			}
-		}(conn)
-
-		// handle WebSocket requests
-		go func() {
-			defer conn.Close()
-			defer close(keepaliveDone)
-
-			for {
-				// read data
-				header, r, err := wsutil.NextReader(conn, ws.StateServerSide)
-				if err != nil {
-					log.Error("read from ws error", "err", err)
-					switch et := err.(type) {
-					case wsutil.ClosedError:
-						// Client close the connection:
-						log.Info("[client disconnect] ClosedError", "code", et.Code, "reason", et.Reason)
-					default:
-						// detect connection has been closed
-						log.Info("read error", "code", et, "err", err)
-						// send Close frame to client
-						conn.Write(ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye-default"))))
-					}
-					// clear connection
-					peer.Disconnect()
-					return
-				}
-
-				// handle Websocket Control Frame: https://www.rfc-editor.org/rfc/rfc6455#section-5.5
-				// there are three types of Control Frame: 0x08(Close), 0x09(Ping) and 0x0A(Pong)
-				// be careful that Control frames can be interjected in the middle of a fragmented message.
-				if header.OpCode.IsControl() {
-					// Close Frame
-					if header.OpCode == ws.OpClose {
-						log.Debug(">GOT CLOSE", "sid", peer.Sid)
-						peer.Disconnect()
-						wsutil.ControlFrameHandler(conn, ws.StateServerSide)
-						// conn.Write(ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye"))))
-						// conn.Close()
-						closeConn(conn, "bye")
-						return
-					}
-
-					// Pong Frame
-					if header.OpCode == ws.OpPong {
-						handlePongFrame(peer.Sid, r, header)
-						continue
-					}
-
-					log.Debug(">GOT Unhandled Control Frame", "sid", peer.Sid, "OpCode", header.OpCode)
-					wsutil.ControlFrameHandler(conn, ws.StateServerSide)
-
-					continue
-				}
-
-				// handle Websocket Data Frames: https://www.rfc-editor.org/rfc/rfc6455#section-5.6
-				// only accept Binary mode message, will break if receive Text mode message
-				if header.OpCode == ws.OpText {
-					log.Error("peer sent text which not allowed", "sid", peer.Sid)
-					// https://datatracker.ietf.org/doc/html/rfc6455#section-7.4.1 1003
-					// conn.Write(ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusUnsupportedData, "no text allowed"))))
-					conn.Close()
-					closeConn(conn, "no text allowed")
-					break
-				}
-
-				_ = peer.HandleSignal(r)
-			}
-		}()
+	// according to https://tools.ietf.org/html/rfc6455#section-5.5.2, Web Browsers will not send Ping frame,
+	// backend server should send Ping frame to keep connection alive, and Web Browsers will auto reply Pong frame when receive Ping frame. But in Chrome DevTools, Ping/Pong frame is not shown.
+	// the dead peer is disconnected by the read error once the connection is closed
+	ka := keepalive().add(conn, pconn, peer.Sid, func() {
+		writeGoingAway(conn, pconn, "pong timeout")
+		conn.Close()
+	})
+
+	// handle WebSocket requests
+	defer conn.Close()
+	defer ka.stop()
+
+	// client may send frames right after the handshake, which are buffered
+	// in the reader of hijacked HTTP connection
+	var src io.Reader = conn
+	if rw.Reader.Buffered() > 0 {
+		src = rw.Reader
+	}
+
+	for !handleFrame(conn, src, state, peer, opts.Deflate) {
+		ka.touch()
+	}
+}
+
+// handleFrame reads and handles the next message from src, returns true if
+// the connection is finished, the peer is disconnected then.
+func handleFrame(conn net.Conn, src io.Reader, state ws.State, peer *chirp.Peer, deflate *chirp.Deflate) (done bool) {
+	// read data
+	header, r, err := wsutil.NextReader(src, state)
+	if err != nil {
+		log.Error("read from ws error", "err", err)
+		switch et := err.(type) {
+		case wsutil.ClosedError:
+			// Client close the connection:
+			log.Info("[client disconnect] ClosedError", "code", et.Code, "reason", et.Reason)
+		default:
+			// detect connection has been closed
+			log.Info("read error", "code", et, "err", err)
+			// send Close frame to client
+			conn.Write(ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye-default"))))
+		}
+		// clear connection
+		peer.Disconnect()
+		return true
+	}
+
+	// handle Websocket Control Frame: https://www.rfc-editor.org/rfc/rfc6455#section-5.5
+	// there are three types of Control Frame: 0x08(Close), 0x09(Ping) and 0x0A(Pong)
+	// be careful that Control frames can be interjected in the middle of a fragmented message.
+	if header.OpCode.IsControl() {
+		// Close Frame
+		if header.OpCode == ws.OpClose {
+			log.Debug(">GOT CLOSE", "sid", peer.Sid)
+			peer.Disconnect()
+			wsutil.ControlFrameHandler(conn, ws.StateServerSide)
+			// conn.Write(ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye"))))
+			// conn.Close()
+			closeConn(conn, "bye")
+			return true
+		}
+
+		// Pong Frame
+		if header.OpCode == ws.OpPong {
+			handlePongFrame(peer, r, header)
+			return false
+		}
+
+		log.Debug(">GOT Unhandled Control Frame", "sid", peer.Sid, "OpCode", header.OpCode)
+		wsutil.ControlFrameHandler(conn, ws.StateServerSide)
+
+		return false
+	}
+
+	// handle Websocket Data Frames: https://www.rfc-editor.org/rfc/rfc6455#section-5.6
+	// only accept Binary mode message, will break if receive Text mode message,
+	// unless the peer negotiated a text codec like JSON
+	if header.OpCode == ws.OpText && !peer.Codec.Text() {
+		log.Error("peer sent text which not allowed", "sid", peer.Sid)
+		// https://datatracker.ietf.org/doc/html/rfc6455#section-7.4.1 1003
+		// conn.Write(ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusUnsupportedData, "no text allowed"))))
+		closeConn(conn, "no text allowed")
+		peer.Disconnect()
+		return true
 	}
+
+	// https://www.rfc-editor.org/rfc/rfc7692#section-6.1, compressed message has RSV1 bit set on its first frame
+	if header.Rsv1() {
+		if deflate == nil {
+			closeConn(conn, "unexpected rsv1 bit")
+			peer.Disconnect()
+			return true
+		}
+		// the compressed message is limited too, before decompressed
+		limit := deflate.MaxMessageSize()
+		buf, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil {
+			log.Error("read compressed message error", "sid", peer.Sid, "err", err)
+			closeConn(conn, "read error")
+			peer.Disconnect()
+			return true
+		}
+		if int64(len(buf)) > limit {
+			log.Error("compressed message too large", "sid", peer.Sid, "limit", limit)
+			closeConn(conn, "message too large")
+			peer.Disconnect()
+			return true
+		}
+		msg, err := deflate.Decompress(buf)
+		if err != nil {
+			log.Error("decompress message error", "sid", peer.Sid, "err", err)
+			closeConn(conn, "decompress error")
+			peer.Disconnect()
+			return true
+		}
+		r = bytes.NewReader(msg)
+	}
+
+	_ = peer.HandleSignal(r)
+	return false
 }
 
 // generatePingFrame return a Ping Frame
 func generatePingFrame() []byte {
 	// according to RFC6455: https://www.rfc-editor.org/rfc/rfc6455#section-5.5.2,
 	// Application Data can be carried by Ping frame, and the payload will be returned in Pong frame from Web Browser automatically, so we can calculate the RTT by this.
-	ts := time.Now().UnixMilli()
+	ts := time.Now().UnixMicro()
 	tsbuf := make([]byte, 8)
 	binary.BigEndian.PutUint64(tsbuf, uint64(ts))
 	pf := ws.MustCompileFrame(ws.NewPingFrame(tsbuf))
@@ -274,8 +395,9 @@ func generatePingFrame() []byte {
 	return pf
 }
 
-// handlePongFrame handle Pong Frame from Web Browser
-func handlePongFrame(sid string, r io.Reader, header ws.Header) error {
+// handlePongFrame handle Pong Frame from Web Browser, the RTT is measured by
+// the timestamp carried by Ping frame.
+func handlePongFrame(peer *chirp.Peer, r io.Reader, header ws.Header) error {
 	// read the Application Data from Pong frame
 	buf := make([]byte, header.Length)
 	_, err := io.ReadFull(r, buf)
@@ -283,11 +405,19 @@ func handlePongFrame(sid string, r io.Reader, header ws.Header) error {
 		log.Error("read PONG payload error", "err", err)
 		return err
 	}
-	// calculate the RTT and prints to stdout
-	appData := int64(binary.BigEndian.Uint64(buf))
-	now := time.Now().UnixMilli()
-	// log.Inspect("\tPONG Payload", "sid", sid, "len", len(buf), "val", appData, "𝚫", now-appData)
-	log.Debug("[PONG]", "sid", sid, "len", len(buf), "buf", fmt.Sprintf("% X", buf), "val", appData, "𝚫", now-appData)
+	// unsolicited Pong frames may carry anything
+	if len(buf) != 8 {
+		log.Debug("[PONG] unsolicited", "sid", peer.Sid, "len", len(buf))
+		return nil
+	}
+	sent := time.UnixMicro(int64(binary.BigEndian.Uint64(buf)))
+	rtt := time.Since(sent)
+	if rtt < 0 || rtt > time.Minute {
+		log.Debug("[PONG] illegal timestamp", "sid", peer.Sid, "sent", sent)
+		return nil
+	}
+	peer.UpdateRTT(rtt)
+	log.Debug("[PONG]", "sid", peer.Sid, "len", len(buf), "buf", fmt.Sprintf("% X", buf), "𝚫", rtt)
 	return nil
 }
 
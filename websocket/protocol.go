@@ -0,0 +1,49 @@
+package websocket
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pilarjs/prscd/psig"
+)
+
+// subprotocolPrefix is the prefix of the `Sec-WebSocket-Protocol` tokens
+// understood by prscd, the token looks like `prscd.<version>[.<codec>]`,
+// e.g. `prscd.v2` or `prscd.v2.json`, msgpack is used if codec is omitted.
+const subprotocolPrefix = "prscd."
+
+// selectSubprotocol picks the first prscd subprotocol with a supported
+// version and codec from the `Sec-WebSocket-Protocol` header value. Tokens of
+// other subprotocols are ignored, if client only offers prscd tokens which
+// are not supported, the error of the first one is returned.
+func selectSubprotocol(header string) (protocol string, version psig.Version, codec psig.Codec, err error) {
+	for _, token := range strings.Split(header, ",") {
+		token = strings.TrimSpace(token)
+		if !strings.HasPrefix(token, subprotocolPrefix) {
+			continue
+		}
+		v, c, perr := parseSubprotocol(token)
+		if perr != nil {
+			if err == nil {
+				err = perr
+			}
+			continue
+		}
+		return token, v, c, nil
+	}
+	return "", "", nil, err
+}
+
+// parseSubprotocol parses a prscd subprotocol token.
+func parseSubprotocol(token string) (psig.Version, psig.Codec, error) {
+	ver, codecName, _ := strings.Cut(strings.TrimPrefix(token, subprotocolPrefix), ".")
+	v, err := psig.ParseVersion(ver)
+	if err != nil {
+		return "", nil, err
+	}
+	c, ok := psig.CodecByName(codecName)
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported codec: %q", codecName)
+	}
+	return v, c, nil
+}
@@ -0,0 +1,219 @@
+package websocket
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	"github.com/pilarjs/prscd/chirp"
+	"github.com/pilarjs/prscd/util"
+)
+
+// errBufferedConn is returned when registering a connection which buffers
+// bytes not seen by epoll.
+var errBufferedConn = errors.New("connection has buffered data")
+
+// wsReactor is the epoll reactor serving plaintext connections, enabled by
+// `WS_REACTOR` env, nil if disabled or not supported on this platform.
+// Connections are parked in epoll without goroutines while idle, frames are
+// read by a pool of `WS_REACTOR_WORKERS` workers once readable, and pings
+// are sent by the keepalive timer wheel shared with other connections.
+// `WS_REACTOR_READ_TIMEOUT` (default 10s, like `WS_HANDSHAKE_TIMEOUT`)
+// limits the time to read each frame once the connection is readable, so
+// slow clients can not hold the workers forever, connections with partial
+// frames are disconnected then. A lower timeout frees the workers sooner
+// but disconnects clients on slow links sending large messages.
+var wsReactor = sync.OnceValue(func() *reactor {
+	if !util.GetEnvBool("WS_REACTOR", false) {
+		return nil
+	}
+	workers := util.GetEnvInt("WS_REACTOR_WORKERS", 8*runtime.NumCPU())
+	readTimeout := util.GetEnvDuration("WS_REACTOR_READ_TIMEOUT", 10*time.Second)
+	r, err := newReactor(max(workers, 1), readTimeout)
+	if err != nil {
+		log.Error("ws.reactor disabled", "err", err)
+		return nil
+	}
+	log.Info("ws.reactor enabled", "workers", workers, "readTimeout", readTimeout)
+	return r
+})
+
+// reactorConn is a WebSocket connection served by the reactor.
+type reactorConn struct {
+	fd      int
+	conn    net.Conn
+	pconn   chirp.Connection
+	peer    *chirp.Peer
+	state   ws.State
+	deflate *chirp.Deflate
+
+	ka     *keepaliveConn
+	closed atomic.Bool
+}
+
+type reactor struct {
+	poller      *poller
+	jobs        chan *reactorConn // readable connections
+	readTimeout time.Duration     // to read the frames of a readable connection
+
+	mu    sync.Mutex
+	conns map[int]*reactorConn // by fd
+}
+
+func newReactor(workers int, readTimeout time.Duration) (*reactor, error) {
+	p, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+	r := &reactor{
+		poller:      p,
+		jobs:        make(chan *reactorConn, workers),
+		readTimeout: readTimeout,
+		conns:       make(map[int]*reactorConn),
+	}
+	connStats.Set("reactor", expvar.Func(func() any {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.conns)
+	}))
+	for range workers {
+		go r.work()
+	}
+	go r.loop()
+	return r, nil
+}
+
+// register parks rc in epoll, the reactor owns the connection since then.
+// Only connections exposing their file descriptor are supported, like
+// plaintext TCP and Unix domain socket connections.
+func (r *reactor) register(rc *reactorConn) error {
+	fd, err := connFD(rc.conn)
+	if err != nil {
+		return err
+	}
+	if b, ok := rc.conn.(interface{ Buffered() int }); ok && b.Buffered() > 0 {
+		return errBufferedConn
+	}
+	rc.fd = fd
+
+	// closing the connection removes it from epoll silently, so the dead
+	// peer is woken up by shutting down the reading side instead, and is
+	// disconnected by the read error
+	rc.ka = keepalive().add(rc.conn, rc.pconn, rc.peer.Sid, func() {
+		writeGoingAway(rc.conn, rc.pconn, "pong timeout")
+		if err := shutdownRead(rc.conn); err != nil {
+			log.Debug("ws.reactor shutdown error", "sid", rc.peer.Sid, "err", err)
+		}
+	})
+
+	r.mu.Lock()
+	r.conns[fd] = rc
+	r.mu.Unlock()
+
+	if err := r.poller.add(fd); err != nil {
+		r.mu.Lock()
+		delete(r.conns, fd)
+		r.mu.Unlock()
+		rc.ka.stop()
+		return err
+	}
+	return nil
+}
+
+// remove the connection from the reactor and close it, the peer should be
+// disconnected by the caller.
+func (r *reactor) remove(rc *reactorConn) {
+	if !rc.closed.CompareAndSwap(false, true) {
+		return
+	}
+	rc.ka.stop()
+	r.mu.Lock()
+	if r.conns[rc.fd] == rc {
+		delete(r.conns, rc.fd)
+	}
+	r.mu.Unlock()
+	// remove from epoll before the fd is closed and reused
+	r.poller.remove(rc.fd)
+	rc.conn.Close()
+}
+
+// loop waits for readable connections and dispatches them to workers.
+func (r *reactor) loop() {
+	fds := make([]int, 0, 128)
+	for {
+		var err error
+		fds, err = r.poller.wait(fds[:0])
+		if err != nil {
+			log.Error("ws.reactor wait error", "err", err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		for _, fd := range fds {
+			r.mu.Lock()
+			rc := r.conns[fd]
+			r.mu.Unlock()
+			if rc != nil {
+				r.jobs <- rc
+			}
+		}
+	}
+}
+
+func (r *reactor) work() {
+	for rc := range r.jobs {
+		if !rc.closed.Load() {
+			r.read(rc)
+		}
+	}
+}
+
+// read handles the messages of a readable connection, then parks it again.
+// Epoll is armed in one-shot mode, so a connection is read by one worker at
+// a time. A frame not received in full within readTimeout fails the read, the
+// bytes of it already read can not be put back, so the connection is closed.
+// The deadline is set per frame, so a burst of frames is not cut off.
+func (r *reactor) read(rc *reactorConn) {
+	for {
+		rc.conn.SetReadDeadline(time.Now().Add(r.readTimeout))
+		if handleFrame(rc.conn, rc.conn, rc.state, rc.peer, rc.deflate) {
+			r.remove(rc)
+			return
+		}
+		rc.ka.touch()
+		// bytes buffered by wrappers like PROXY protocol are not seen by epoll
+		if b, ok := rc.conn.(interface{ Buffered() int }); !ok || b.Buffered() == 0 {
+			break
+		}
+	}
+	rc.conn.SetReadDeadline(time.Time{})
+
+	if err := r.poller.rearm(rc.fd); err != nil {
+		log.Error("ws.reactor rearm error", "sid", rc.peer.Sid, "err", err)
+		rc.peer.Disconnect()
+		r.remove(rc)
+	}
+}
+
+// connFD returns the file descriptor of conn.
+func connFD(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	fd := -1
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// poller is the epoll instance of reactor.
+type poller struct {
+	epfd   int
+	events []unix.EpollEvent
+}
+
+func newPoller() (*poller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &poller{epfd: epfd, events: make([]unix.EpollEvent, 128)}, nil
+}
+
+// events of interest, one-shot mode disables the fd once it is reported
+// until it is rearmed by the worker which reads it.
+const pollEvents = unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT
+
+func (p *poller) add(fd int) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: pollEvents, Fd: int32(fd)})
+}
+
+func (p *poller) rearm(fd int) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Events: pollEvents, Fd: int32(fd)})
+}
+
+func (p *poller) remove(fd int) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+}
+
+// wait blocks until some fds are readable, or hung up, and appends them to fds.
+func (p *poller) wait(fds []int) ([]int, error) {
+	n, err := unix.EpollWait(p.epfd, p.events, -1)
+	if err != nil {
+		if errors.Is(err, unix.EINTR) {
+			return fds, nil
+		}
+		return fds, err
+	}
+	for _, ev := range p.events[:n] {
+		fds = append(fds, int(ev.Fd))
+	}
+	return fds, nil
+}
+
+// shutdownRead shuts down the reading side of conn, epoll reports it
+// readable then, and reading from it returns io.EOF.
+func shutdownRead(conn net.Conn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) { serr = unix.Shutdown(int(fd), unix.SHUT_RD) }); err != nil {
+		return err
+	}
+	return serr
+}
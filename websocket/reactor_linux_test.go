@@ -0,0 +1,71 @@
+package websocket
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPoller(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	fd, err := connFD(&limitedConn{Conn: server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPoller()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.add(fd); err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func() []int {
+		ch := make(chan []int, 1)
+		go func() {
+			fds, _ := p.wait(nil)
+			ch <- fds
+		}()
+		select {
+		case fds := <-ch:
+			return fds
+		case <-time.After(200 * time.Millisecond):
+			return nil
+		}
+	}
+
+	client.Write([]byte("a"))
+	if fds := wait(); len(fds) != 1 || fds[0] != fd {
+		t.Fatalf("expected fd %d readable, got %v", fd, fds)
+	}
+
+	// one-shot, not reported again until rearmed
+	client.Write([]byte("b"))
+	if fds := wait(); fds != nil {
+		t.Fatalf("expected no event before rearm, got %v", fds)
+	}
+	if err := p.rearm(fd); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(250 * time.Millisecond) // the pending wait of last round consumes the event
+	server.Read(make([]byte, 2))
+
+	if err := p.remove(fd); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package websocket
+
+import (
+	"errors"
+	"net"
+)
+
+// poller is only implemented by epoll on Linux, connections are served by
+// goroutines on other platforms.
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, errors.New("epoll reactor is only supported on linux")
+}
+
+func (p *poller) add(fd int) error              { return errors.ErrUnsupported }
+func (p *poller) rearm(fd int) error            { return errors.ErrUnsupported }
+func (p *poller) remove(fd int) error           { return errors.ErrUnsupported }
+func (p *poller) wait(fds []int) ([]int, error) { return fds, errors.ErrUnsupported }
+
+func shutdownRead(conn net.Conn) error { return errors.ErrUnsupported }
@@ -0,0 +1,211 @@
+package webtransport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/quic-go/quic-go/quicvarint"
+
+	"github.com/pilarjs/prscd/util"
+)
+
+// draft is the version of WebTransport over HTTP/3 negotiated with client.
+type draft int
+
+const (
+	// draft02 is https://www.ietf.org/archive/id/draft-ietf-webtrans-http3-02.html,
+	// still spoken by older browsers.
+	draft02 draft = iota + 2
+	// draftLatest is draft-07 and later, which depend on RFC 9297 HTTP
+	// Datagrams and the capsule protocol.
+	draftLatest
+)
+
+// draftNone means client does not support WebTransport, e.g. plain HTTP/3
+// clients.
+const draftNone draft = 0
+
+func (d draft) String() string {
+	switch d {
+	case draft02:
+		return "draft02"
+	case draftLatest:
+		return "draft07+"
+	}
+	return "none"
+}
+
+// SETTINGS parameters of HTTP/3 which are related to WebTransport.
+const (
+	// settingEnableConnectProtocol enables extended CONNECT, https://www.rfc-editor.org/rfc/rfc9220#section-5
+	settingEnableConnectProtocol = 0x08
+	// settingH3Datagram is H3_DATAGRAM of https://www.rfc-editor.org/rfc/rfc9297#section-5.1
+	settingH3Datagram = 0x33
+	// settingH3DatagramDraft is H3_DATAGRAM of draft-ietf-masque-h3-datagram-05, used with draft02
+	settingH3DatagramDraft = 0xffd277
+	// settingEnableWebTransport is SETTINGS_ENABLE_WEBTRANSPORT of draft02
+	settingEnableWebTransport = 0x2b603742
+	// settingWebTransportMaxSessions is SETTINGS_WEBTRANSPORT_MAX_SESSIONS of draft-07 and later
+	settingWebTransportMaxSessions = 0xc671706a
+)
+
+// maxSessions is the max number of concurrent WebTransport sessions on a QUIC
+// connection, set by env `WT_MAX_SESSIONS`, default 16. It is loaded on first
+// use, after .env is loaded.
+var maxSessions = sync.OnceValue(func() int {
+	return max(util.GetEnvInt("WT_MAX_SESSIONS", 16), 1)
+})
+
+// serverSettings are sent to every client, the parameters of both draft02 and
+// later drafts are announced, unknown ones are ignored by client.
+func serverSettings() [][2]uint64 {
+	return [][2]uint64{
+		{settingEnableConnectProtocol, 1},
+		{settingH3Datagram, 1},
+		{settingH3DatagramDraft, 1},
+		{settingEnableWebTransport, 1},
+		{settingWebTransportMaxSessions, uint64(maxSessions())},
+	}
+}
+
+// negotiateDraft selects the draft by the SETTINGS of client, later drafts
+// are preferred.
+func negotiateDraft(settings map[uint64]uint64) (draft, error) {
+	if settings[settingWebTransportMaxSessions] > 0 {
+		if settings[settingH3Datagram] != 1 {
+			return draftNone, errors.New("H3_DATAGRAM must be enabled")
+		}
+		return draftLatest, nil
+	}
+	if settings[settingEnableWebTransport] == 1 {
+		if settings[settingH3DatagramDraft] != 1 && settings[settingH3Datagram] != 1 {
+			return draftNone, errors.New("H3_DATAGRAM must be enabled")
+		}
+		return draft02, nil
+	}
+	return draftNone, errors.New("client does not support WebTransport")
+}
+
+// HTTP/3 frame types used on the CONNECT stream, https://www.rfc-editor.org/rfc/rfc9114#section-7.2
+const (
+	frameData    = 0x00
+	frameHeaders = 0x01
+)
+
+// capsule types, https://www.rfc-editor.org/rfc/rfc9297#section-3.2
+const (
+	// capsuleCloseSession is WT_CLOSE_SESSION
+	capsuleCloseSession = 0x2843
+	// capsuleDrainSession is WT_DRAIN_SESSION
+	capsuleDrainSession = 0x78ae
+)
+
+// errSessionClosed is returned by readCapsule when client closes the session
+// by WT_CLOSE_SESSION capsule.
+var errSessionClosed = errors.New("webtransport session closed by client")
+
+// dataFrameReader reads the payload of DATA frames on the CONNECT stream,
+// other frames are skipped. The capsules of later drafts are carried by it.
+type dataFrameReader struct {
+	r    quicvarint.Reader
+	left uint64 // unread bytes of current DATA frame
+}
+
+func newDataFrameReader(r io.Reader) *dataFrameReader {
+	return &dataFrameReader{r: quicvarint.NewReader(r)}
+}
+
+func (d *dataFrameReader) Read(p []byte) (int, error) {
+	for d.left == 0 {
+		ftype, err := quicvarint.Read(d.r)
+		if err != nil {
+			return 0, err
+		}
+		flen, err := quicvarint.Read(d.r)
+		if err != nil {
+			return 0, err
+		}
+		if ftype == frameData {
+			d.left = flen
+			continue
+		}
+		// unknown or trailing HEADERS frames are ignored
+		if _, err := io.CopyN(io.Discard, d.r, int64(flen)); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > d.left {
+		p = p[:d.left]
+	}
+	n, err := d.r.Read(p)
+	d.left -= uint64(n)
+	return n, err
+}
+
+// capsule is a capsule of RFC 9297 sent on the CONNECT stream.
+type capsule struct {
+	Type  uint64
+	Value []byte
+}
+
+// readCapsule reads the next capsule, errSessionClosed is returned on
+// WT_CLOSE_SESSION, which carries the error code and reason of client.
+func readCapsule(r quicvarint.Reader) (*capsule, error) {
+	ctype, err := quicvarint.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	clen, err := quicvarint.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	// capsules of prscd are small, WT_CLOSE_SESSION limits the reason to 1024 bytes
+	if clen > 4+1024 {
+		return nil, fmt.Errorf("capsule %#x too large: %d", ctype, clen)
+	}
+	c := &capsule{Type: ctype, Value: make([]byte, clen)}
+	if _, err := io.ReadFull(r, c.Value); err != nil {
+		return nil, err
+	}
+	if ctype == capsuleCloseSession {
+		if len(c.Value) < 4 {
+			return nil, errors.New("WT_CLOSE_SESSION is malformed")
+		}
+		code := uint32(c.Value[0])<<24 | uint32(c.Value[1])<<16 | uint32(c.Value[2])<<8 | uint32(c.Value[3])
+		return c, fmt.Errorf("%w, code: %d, reason: %q", errSessionClosed, code, c.Value[4:])
+	}
+	return c, nil
+}
+
+// writeCloseSession writes the WT_CLOSE_SESSION capsule in a DATA frame on
+// the CONNECT stream, to close the session on behalf of server.
+func writeCloseSession(w io.Writer, code uint32, reason string) error {
+	if len(reason) > 1024 {
+		reason = reason[:1024]
+	}
+	value := make([]byte, 0, 4+len(reason))
+	value = append(value, byte(code>>24), byte(code>>16), byte(code>>8), byte(code))
+	value = append(value, reason...)
+
+	c := quicvarint.Append(nil, capsuleCloseSession)
+	c = quicvarint.Append(c, uint64(len(value)))
+	c = append(c, value...)
+
+	buf := quicvarint.Append(nil, frameData)
+	buf = quicvarint.Append(buf, uint64(len(c)))
+	buf = append(buf, c...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// parseDatagram strips the Quarter Stream ID prefix of the datagram, returns
+// the session ID and the payload.
+func parseDatagram(b []byte) (sessionID uint64, payload []byte, err error) {
+	qsid, n, err := quicvarint.Parse(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return qsid * 4, b[n:], nil
+}
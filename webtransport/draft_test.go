@@ -0,0 +1,89 @@
+package webtransport
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateDraft(t *testing.T) {
+	d, err := negotiateDraft(map[uint64]uint64{settingEnableWebTransport: 1, settingH3DatagramDraft: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, draft02, d)
+
+	// later drafts are preferred if client supports both
+	d, err = negotiateDraft(map[uint64]uint64{
+		settingEnableWebTransport:      1,
+		settingH3DatagramDraft:         1,
+		settingWebTransportMaxSessions: 1,
+		settingH3Datagram:              1,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, draftLatest, d)
+
+	_, err = negotiateDraft(map[uint64]uint64{settingWebTransportMaxSessions: 1})
+	assert.Error(t, err)
+
+	_, err = negotiateDraft(map[uint64]uint64{settingH3Datagram: 1})
+	assert.Error(t, err)
+}
+
+func TestReadCapsule(t *testing.T) {
+	var capsules []byte
+	// WT_DRAIN_SESSION
+	capsules = quicvarint.Append(capsules, capsuleDrainSession)
+	capsules = quicvarint.Append(capsules, 0)
+	// WT_CLOSE_SESSION with code 7 and reason "bye"
+	capsules = quicvarint.Append(capsules, capsuleCloseSession)
+	capsules = quicvarint.Append(capsules, 7)
+	capsules = append(capsules, 0, 0, 0, 7, 'b', 'y', 'e')
+
+	// capsules are split into two DATA frames, with an unknown frame between them
+	var stream []byte
+	stream = quicvarint.Append(stream, frameData)
+	stream = quicvarint.Append(stream, 3)
+	stream = append(stream, capsules[:3]...)
+	stream = quicvarint.Append(stream, 0x21)
+	stream = quicvarint.Append(stream, 2)
+	stream = append(stream, 0xff, 0xff)
+	stream = quicvarint.Append(stream, frameData)
+	stream = quicvarint.Append(stream, uint64(len(capsules)-3))
+	stream = append(stream, capsules[3:]...)
+
+	r := quicvarint.NewReader(newDataFrameReader(bytes.NewReader(stream)))
+	c, err := readCapsule(r)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(capsuleDrainSession), c.Type)
+
+	_, err = readCapsule(r)
+	assert.True(t, errors.Is(err, errSessionClosed))
+	assert.Contains(t, err.Error(), "code: 7")
+	assert.Contains(t, err.Error(), "bye")
+}
+
+func TestWriteCloseSession(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeCloseSession(&buf, 3, "idle timeout"))
+
+	r := quicvarint.NewReader(newDataFrameReader(&buf))
+	_, err := readCapsule(r)
+	assert.True(t, errors.Is(err, errSessionClosed))
+	assert.Contains(t, err.Error(), "code: 3")
+	assert.Contains(t, err.Error(), "idle timeout")
+}
+
+func TestDatagram(t *testing.T) {
+	for _, sessionID := range []uint64{0, 4, 1024} {
+		msg := append(quicvarint.Append(nil, sessionID/4), "hello"...)
+		sid, payload, err := parseDatagram(msg)
+		assert.NoError(t, err)
+		assert.Equal(t, sessionID, sid)
+		assert.Equal(t, []byte("hello"), payload)
+	}
+
+	_, _, err := parseDatagram(nil)
+	assert.Error(t, err)
+}
@@ -54,25 +54,22 @@ func sendSettingsFrame(sess quic.Connection) error {
 	// 7.2.4. SETTINGS
 	// The SETTINGS frame (type=0x04) conveys configuration parameters that affect how endpoints communicate, such as preferences and constraints on peer behavior. Individually, a SETTINGS parameter can also be referred to as a "setting"; the identifier and value of each setting parameter can be referred to as a "setting identifier" and a "setting value".
 	buf = quicvarint.Append(buf, 0x04)
-	var l uint64
 	// H3_DATAGRAM
-	// https://datatracker.ietf.org/doc/html/draft-ietf-masque-h3-datagram-05#section-9.1
-	// +==============+==========+===============+=========+
-	// | Setting Name | Value    | Specification | Default |
-	// +==============+==========+===============+=========+
-	// | H3_DATAGRAM  | 0xffd277 | This Document | 0       |
-	// +--------------+----------+---------------+---------+
-	l += uint64(quicvarint.Len(0xffd277) + quicvarint.Len(1))
+	// https://www.rfc-editor.org/rfc/rfc9297#section-5.1, and 0xffd277 of
+	// draft-ietf-masque-h3-datagram-05 for draft02 clients.
 	// SETTINGS_ENABLE_WEBTRANPORT
 	// https://www.ietf.org/archive/id/draft-ietf-webtrans-http3-02.html#section-8.2
 	// The SETTINGS_ENABLE_WEBTRANSPORT parameter indicates that the specified HTTP/3 connection is
 	// WebTransport-capable.
-	// Setting Name:ENABLE_WEBTRANSPORT
-	// Value:0x2b603742
-	// Default:0
-	l += uint64(quicvarint.Len(0x2b603742) + quicvarint.Len(1))
-	// // ???
-	// l += uint64(quicvarint.Len(0x276) + quicvarint.Len(1))
+	// SETTINGS_WEBTRANSPORT_MAX_SESSIONS
+	// https://www.ietf.org/archive/id/draft-ietf-webtrans-http3-07.html#section-8.2
+	// replaces SETTINGS_ENABLE_WEBTRANSPORT since draft-07, and requires
+	// SETTINGS_ENABLE_CONNECT_PROTOCOL of RFC 9220.
+	settings := serverSettings()
+	var l uint64
+	for _, setting := range settings {
+		l += uint64(quicvarint.Len(setting[0]) + quicvarint.Len(setting[1]))
+	}
 	// write Length
 	buf = quicvarint.Append(buf, l)
 	// Write value
@@ -89,13 +86,10 @@ func sendSettingsFrame(sess quic.Connection) error {
 	//   Length (i),
 	//   Setting (..) ...,
 	// }
-	//
-	// quicvarint.Write(buf, 0x276)
-	// quicvarint.Write(buf, 1)
-	buf = quicvarint.Append(buf, 0xffd277) // H3_DATAGRAM
-	buf = quicvarint.Append(buf, 1)
-	buf = quicvarint.Append(buf, 0x2b603742) // SETTINGS_ENABLE_WEBTRANSPORT
-	buf = quicvarint.Append(buf, 1)
+	for _, setting := range settings {
+		buf = quicvarint.Append(buf, setting[0])
+		buf = quicvarint.Append(buf, setting[1])
+	}
 
 	log.Debug("\t[len=%d] %# x", len(buf), buf)
 	_, err = respStream.Write(buf)
@@ -107,26 +101,42 @@ func sendSettingsFrame(sess quic.Connection) error {
 	return nil
 }
 
-func receiveSettingsFrame(sess quic.Connection) error {
-	recvSettingStream, _ := sess.AcceptUniStream(sess.Context())
+// receiveSettingsFrame reads the SETTINGS frame on the control stream of
+// client, the QPACK streams opened by client before it are left untouched.
+func receiveSettingsFrame(sess quic.Connection) (map[uint64]uint64, error) {
 	log.Debug("[2] receive client SETTINGS frame")
-	sqr := quicvarint.NewReader(recvSettingStream)
-	// stream type should = 0x00, control stream
-	sty, err := quicvarint.Read(sqr)
-	if err != nil {
-		return err
+	var sqr quicvarint.Reader
+	var recvSettingStream quic.ReceiveStream
+	for {
+		str, err := sess.AcceptUniStream(sess.Context())
+		if err != nil {
+			return nil, err
+		}
+		sqr = quicvarint.NewReader(str)
+		// stream type should = 0x00, control stream
+		sty, err := quicvarint.Read(sqr)
+		if err != nil {
+			return nil, err
+		}
+		log.Debug("\tStreamType: %# x\r", sty)
+		if sty == 0x00 {
+			recvSettingStream = str
+			break
+		}
 	}
-	log.Debug("\tStreamType: %# x\r", sty)
 	// frame type should = 0x04, SETTINGS frame
 	ftype, err := quicvarint.Read(sqr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	log.Debug("\tFrameType: %# x\r", ftype)
+	if ftype != 0x04 {
+		return nil, errors.New("the first frame of control stream should be SETTINGS")
+	}
 	// Settings length
 	flen, err := quicvarint.Read(sqr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	log.Debug("\tLength: %# x(oct=%d)\r", flen, flen)
 	// Frame Payload ...
@@ -134,23 +144,23 @@ func receiveSettingsFrame(sess quic.Connection) error {
 	settingsPayload := make(map[uint64]uint64)
 	payloadBuf := make([]byte, flen)
 	if _, err := io.ReadFull(recvSettingStream, payloadBuf); err != nil {
-		return err
+		return nil, err
 	}
 	bb := bytes.NewReader(payloadBuf)
 	for bb.Len() > 0 {
 		identifier, err := quicvarint.Read(bb)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		value, err := quicvarint.Read(bb)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		settingsPayload[identifier] = value
 		log.Debug("\tidentifier:%# x, value: %d (%#x)\r", identifier, value, value)
 	}
 
-	return nil
+	return settingsPayload, nil
 }
 
 func readHeaderFrame(reqStream io.Reader) ([]qpack.HeaderField, error) {
@@ -175,7 +185,7 @@ func readHeaderFrame(reqStream io.Reader) ([]qpack.HeaderField, error) {
 	log.Debug("\theader block: %# x", headerBlockLength)
 
 	// header frame id is 0x01
-	if hdr != 0x01 {
+	if hdr != frameHeaders {
 		return nil, errors.New("not header frame, should force close connection")
 	}
 
@@ -187,19 +197,33 @@ func readHeaderFrame(reqStream io.Reader) ([]qpack.HeaderField, error) {
 	return decoder.DecodeFull(headerBlock)
 }
 
-func writeResponseHeaderFrame(w io.Writer, status int) error {
-	// https://www.ietf.org/archive/id/draft-ietf-webtrans-http3-02.html#name-negotiating-the-draft-versi
-	// The header corresponding to the
-	// version described in this draft is Sec-Webtransport-Http3-Draft02;
-	// its value SHALL be 1. The server SHALL reply with a Sec-
-	// Webtransport-Http3-Draft header indicating the selected version; its
-	// value SHALL be draft02 for the version described in this draft.
-	respHeader := http.Header{}
-	respHeader.Add("Sec-Webtransport-Http3-Draft", "draft02")
+func writeResponseHeaderFrame(w io.Writer, d draft, status int, respHeader http.Header) error {
+	if d == draft02 {
+		// https://www.ietf.org/archive/id/draft-ietf-webtrans-http3-02.html#name-negotiating-the-draft-versi
+		// The header corresponding to the
+		// version described in this draft is Sec-Webtransport-Http3-Draft02;
+		// its value SHALL be 1. The server SHALL reply with a Sec-
+		// Webtransport-Http3-Draft header indicating the selected version; its
+		// value SHALL be draft02 for the version described in this draft.
+		// Later drafts are negotiated by SETTINGS only.
+		respHeader.Add("Sec-Webtransport-Http3-Draft", "draft02")
+	}
 
 	// From the client's perspective, a WebTransport session is established
 	// when the client receives a 2xx response.  From the server's
 	// perspective, a session is established once it sends a 2xx response.
+	if err := writeHeadersFrame(w, status, respHeader); err != nil {
+		return err
+	}
+
+	log.Debug("[4] Response HEADER frame with status:%d", status)
+	log.Debug("\t%v", respHeader)
+
+	return nil
+}
+
+// writeHeadersFrame writes the response status and header in a HEADERS frame.
+func writeHeadersFrame(w io.Writer, status int, respHeader http.Header) error {
 	var qpackHeaders bytes.Buffer
 	encoder := qpack.NewEncoder(&qpackHeaders)
 	encoder.WriteField(qpack.HeaderField{
@@ -223,7 +247,7 @@ func writeResponseHeaderFrame(w io.Writer, status int) error {
 	// 	Length (i),
 	// 	Encoded Field Section (..),
 	// }
-	buf = quicvarint.Append(buf, 0x01)
+	buf = quicvarint.Append(buf, frameHeaders)
 	buf = quicvarint.Append(buf, uint64(qpackHeaders.Len()))
 
 	respWriter := bufio.NewWriter(w)
@@ -233,12 +257,5 @@ func writeResponseHeaderFrame(w io.Writer, status int) error {
 	if _, err := respWriter.Write(qpackHeaders.Bytes()); err != nil {
 		return err
 	}
-	if err := respWriter.Flush(); err != nil {
-		return err
-	}
-
-	log.Debug("[4] Response HEADER frame with status:%d", status)
-	log.Debug("\t%v", respHeader)
-
-	return nil
+	return respWriter.Flush()
 }
@@ -2,39 +2,71 @@
 package webtransport
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
+	"net"
+	"net/http"
 	"net/url"
 	"time"
 
+	"github.com/quic-go/qpack"
 	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
 
 	"github.com/pilarjs/prscd/chirp"
+	"github.com/pilarjs/prscd/psig"
 	"github.com/pilarjs/prscd/util"
 )
 
 var log = util.Log
 
-// ListenAndServe create webtransport server
-func ListenAndServe(addr string, tlsConfig *tls.Config) {
+// ListenAndServe create webtransport server, plain HTTP/3 requests are served
+// by handler.
+func ListenAndServe(addr string, tlsConfig *tls.Config, handler http.Handler) {
+	Serve(Listen(addr, tlsConfig), handler)
+}
+
+// Listen binds the QUIC listener of webtransport server on addr, halt if
+// error occurs, the listener is served by Serve.
+func Listen(addr string, tlsConfig *tls.Config) *quic.Listener {
+	// dead clients are detected by QUIC, keep-alive packets are sent every
+	// half of the idle timeout, and the connection is closed if nothing is
+	// received within it, then all its sessions are disconnected
+	idleTimeout := util.GetEnvDuration("WT_IDLE_TIMEOUT", 6*time.Second)
 	quicConfig := &quic.Config{
 		EnableDatagrams:    true,
-		KeepAlivePeriod:    30 * time.Second,
+		KeepAlivePeriod:    idleTimeout / 2,
 		MaxIncomingStreams: 10000,
-		MaxIdleTimeout:     6 * time.Second, // when Read timeout
+		MaxIdleTimeout:     idleTimeout, // when Read timeout
+		Tracer:             rttTracer,
 	}
 
-	ln, err := quic.ListenAddr(addr, tlsConfig, quicConfig)
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		log.Fatal(err)
-		return
+		return nil
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		log.Fatal(err)
+		return nil
+	}
+	// the RTT of connections is measured by QUIC
+	tr := &quic.Transport{Conn: udpConn, ConnContext: withConnRTT}
+	ln, err := tr.Listen(tlsConfig, quicConfig)
+	if err != nil {
+		log.Fatal(err)
+		return nil
 	}
 	log.Info("prscd start WebTransport Server", "addr", ln.Addr())
 
 	log.Debug("tls.NextProtos", "value", tlsConfig.NextProtos)
+	return ln
+}
 
+// Serve serves the sessions accepted by ln.
+func Serve(ln *quic.Listener, handler http.Handler) {
 	// processing request
 	for {
 		sess, err := ln.Accept(context.Background())
@@ -43,11 +75,11 @@ func ListenAndServe(addr string, tlsConfig *tls.Config) {
 			continue
 		}
 		log.Info("+Session: %s", sess.RemoteAddr().String())
-		go handleConnection(sess)
+		go handleConnection(sess, handler)
 	}
 }
 
-func handleConnection(sess quic.Connection) {
+func handleConnection(sess quic.Connection, handler http.Handler) {
 	closeReason := "cc-88-cc"
 	defer func() {
 		log.Debug("handleConnection", "+closeReason", closeReason)
@@ -91,94 +123,193 @@ func handleConnection(sess quic.Connection) {
 	}
 
 	// Step 2: Server receive SETTINGS frame from client
-	err = receiveSettingsFrame(sess)
+	settings, err := receiveSettingsFrame(sess)
 	if err != nil {
 		log.Error("webtrans|handleConnection", "receiveSettingsFrame error", err)
 		closeReason = "error in receive settings frame"
 		return
 	}
+	// plain HTTP/3 clients do not support WebTransport, their requests other
+	// than extended CONNECT are still served
+	d, err := negotiateDraft(settings)
+	if err != nil {
+		log.Debug("webtrans|handleConnection", "negotiateDraft error", err)
+	}
+	log.Debug("webtrans|handleConnection", "draft", d)
+
+	// Step 3: accept request streams until the connection is closed, each
+	// extended CONNECT request establishes a WebTransport session with its own
+	// peer, other requests are served by handler
+	sessions := newSessionRouter(maxSessions())
+	go sessions.receiveDatagrams(sess)
+	for {
+		stream, err := sess.AcceptStream(sess.Context())
+		if err != nil {
+			// if client close the connection, error will occurs here
+			// for example: err:timeout: no recent network activity
+			log.Debug("webtrans|handleConnection", "acceptStream error", err)
+			closeReason = "client disconnected"
+			return
+		}
+		log.Debug("webtrans|handleConnection", "request stream accepted", stream.StreamID())
+		go handleRequestStream(sess, stream, d, sessions, handler)
+	}
+}
 
-	// Step 3: wait for reading client HTTP CONNECT (client indication)
-	stream, err := sess.AcceptStream(context.Background())
+// handleRequestStream dispatches the request on stream by its headers.
+func handleRequestStream(sess quic.Connection, stream quic.Stream, d draft, sessions *sessionRouter, handler http.Handler) {
+	headers, err := readHeaderFrame(stream)
 	if err != nil {
-		log.Error("webtrans|handleConnection", "acceptStream error", err)
-		closeReason = "error in accept stream"
+		// not a request, e.g. WebTransport bidirectional stream which is not supported
+		log.Error("webtrans|handleRequestStream", "readHeaderFrame error", err)
+		stream.CancelRead(quic.StreamErrorCode(0x10b)) // H3_REQUEST_REJECTED
+		stream.CancelWrite(quic.StreamErrorCode(0x10b))
 		return
 	}
-	log.Debug("webtrans|handleConnection", "request stream accepted", stream.StreamID())
 
-	var publicKey, userID string
-	status, err := receiveHTTPConnectHeaderFrame(stream, &publicKey, &userID)
+	if isExtendedConnect(headers) {
+		handleSession(sess, stream, headers, d, sessions)
+		return
+	}
+	serveHTTP(sess, stream, headers, handler)
+}
+
+// handleSession serves the WebTransport session established by the CONNECT
+// request on stream, the session lives as long as the stream.
+func handleSession(sess quic.Connection, stream quic.Stream, headers []qpack.HeaderField, d draft, sessions *sessionRouter) {
+	var publicKey, userID, origin string
+	var version psig.Version
+	status, err := parseHTTPConnectHeaders(headers, d, &publicKey, &userID, &origin, &version)
 	if err != nil {
-		log.Error("webtrans|handleConnection", "receiveHTTPConnectHeaderFrame error", err)
-		closeReason = err.Error()
+		log.Error("webtrans|handleSession", "parseHTTPConnectHeaders error", err)
+		respHeader := http.Header{}
+		if errors.Is(err, psig.ErrUnsupportedVersion) {
+			// tell client which versions are supported
+			respHeader.Add("Prscd-Protocols", psig.SupportedVersionsString())
+		}
+		writeResponseHeaderFrame(stream, d, status, respHeader)
+		stream.Close()
 		return
 	}
 
-	appID, credential, ok := chirp.AuthUserAndGetYoMoCredential(publicKey)
-	if !ok {
-		status = 401
+	respHeader := http.Header{}
+	respHeader.Add("Prscd-Protocol", string(version))
+	reject := func(status int, reason string) {
+		log.Error("webtrans|handleSession", "reject", reason, "status", status, "remoteAddr", sess.RemoteAddr().String())
+		writeResponseHeaderFrame(stream, d, status, respHeader)
+		stream.Close()
 	}
 
-	// Step 4: response HEADER frame if client is valid
-	err = writeResponseHeaderFrame(stream, status)
-	if err != nil {
-		log.Error("webtrans|handleConnection", "writeResponseHeaderFrame error", err)
-		closeReason = "error in write response header frame"
+	// clients presenting a verified certificate skip the public key
+	var appID, credential string
+	var cidVerified bool
+	tlsState := sess.ConnectionState().TLS
+	if cert := chirp.VerifiedClientCertificate(&tlsState); cert != nil {
+		var ok bool
+		appID, userID, credential, ok = chirp.AuthClientCertificate(cert)
+		if !ok || userID == "" {
+			reject(http.StatusForbidden, "illegal client certificate")
+			return
+		}
+		cidVerified = true
+	} else {
+		var ok bool
+		appID, credential, ok = chirp.AuthUserAndGetYoMoCredential(publicKey)
+		if !ok {
+			reject(http.StatusUnauthorized, "illegal public key")
+			return
+		}
+	}
+
+	if err := chirp.CheckOrigin(appID, origin); err != nil {
+		reject(http.StatusForbidden, err.Error())
 		return
 	}
 
-	if status >= 300 {
-		closeReason = "failed with response status other than 2xx"
+	if err := chirp.CheckPeerQuota(appID); err != nil {
+		reject(http.StatusTooManyRequests, err.Error())
 		return
 	}
 
-	log.Debug("webtrans|handleConnection", "Prepared! Start to work ... uid: %s", userID)
+	// the session is identified by the stream ID of CONNECT request
+	sessionID := uint64(stream.StreamID())
+	if !sessions.add(sessionID) {
+		reject(http.StatusTooManyRequests, "too many sessions")
+		return
+	}
+	defer sessions.remove(sessionID)
 
-	// Step 5: start to processing chirp protocol
-	pconn := chirp.NewWebTransportConnection(sess)
 	// now, the authorization is done, we can create realm instance by appID
 	node := chirp.GetOrCreateRealm(appID, credential)
 	if node == nil {
-		closeReason = "can not connect to yomo zipper"
+		reject(http.StatusServiceUnavailable, "can not connect to yomo zipper")
 		return
 	}
 
+	// Step 4: response HEADER frame if client is valid
+	err = writeResponseHeaderFrame(stream, d, http.StatusOK, respHeader)
+	if err != nil {
+		log.Error("webtrans|handleSession", "writeResponseHeaderFrame error", err)
+		stream.CancelRead(quic.StreamErrorCode(0x102)) // H3_INTERNAL_ERROR
+		stream.CancelWrite(quic.StreamErrorCode(0x102))
+		return
+	}
+
+	log.Debug("webtrans|handleSession", "Prepared! Start to work ... uid: %s", userID)
+
+	// Step 5: start to processing chirp protocol
+	pconn := chirp.NewWebTransportConnection(sess, stream.StreamID())
 	peer := node.AddPeer(pconn, userID)
-	log.Info("webtrans|handleConnection", "Upgrade done! peer.Sid=", peer.Sid, "peer.Cid=", peer.Cid)
+	peer.Version = version
+	peer.CidVerified = cidVerified
+	if rtt := rttOf(sess); rtt != nil {
+		peer.SetRTTSource(rtt.get)
+	}
+	established := sessions.bind(sessionID, peer)
+	log.Info("webtrans|handleSession", "Upgrade done! peer.Sid=", peer.Sid, "peer.Cid=", peer.Cid, "version", peer.Version, "draft", d)
 
 	// TODO: send `connected_ack` signalling to client
 
-	// Handle Datagram
-	go func() {
-		for {
-			msg, err := sess.ReceiveDatagram(context.Background())
-			if err != nil {
-				// ignore errors here, we will handle client close event in stream loop
-				log.Error("webtrans|handleConnection", "stream.Read error", err)
-				return
-			}
-			log.Debug("webtrans|handleConnection", "ReceiveMessage", msg)
-			// log.Debug("ReceiveMessage: %# x", msg)
-			// be careful, the first byte of msg is 0x00
-			reader := bytes.NewReader(msg[1:])
-			peer.HandleSignal(reader)
-		}
-	}()
+	if timeout := sessionIdleTimeout(); timeout > 0 {
+		timer := watchIdle(established, timeout, func() {
+			log.Info("webtrans|handleSession", "idle timeout", timeout, "sid", peer.Sid)
+			closeSession(stream, d, "idle timeout")
+		})
+		defer timer.Stop()
+	}
 
+	// the CONNECT stream carries capsules since draft-07, draft02 clients
+	// send nothing on it until the session is closed
+	capsules := quicvarint.NewReader(newDataFrameReader(stream))
 	for {
-		var buf = make([]byte, 1024)
-		_, err := stream.Read(buf)
+		c, err := readCapsule(capsules)
 		if err != nil {
-			// if client close the connection, error will occurs here
-			// for example: err:timeout: no recent network activity
-			log.Error("webtrans|handleConnection", "stream.Read error", err)
+			// if client close the session or the connection, error will occurs here
+			// for example: err:timeout: no recent network activity, or
+			// errSessionClosed if client sends WT_CLOSE_SESSION
+			log.Error("webtrans|handleSession", "stream.Read error", err)
 			peer.Disconnect()
 			stream.Close()
-			sess.CloseWithError(0, "client disconnected")
-			break
+			return
+		}
+		established.touch()
+		// WT_DRAIN_SESSION and unknown capsules are ignored
+		log.Debug("webtrans|handleSession", "capsule", c.Type)
+	}
+}
+
+// closeSession closes the session on behalf of server, the peer is
+// disconnected by the reader of CONNECT stream then. Draft02 clients do not
+// understand capsules, the stream is closed only.
+func closeSession(stream quic.Stream, d draft, reason string) {
+	if d != draft02 {
+		stream.SetWriteDeadline(time.Now().Add(time.Second))
+		if err := writeCloseSession(stream, 0, reason); err != nil {
+			log.Debug("webtrans|closeSession", "writeCloseSession error", err)
 		}
 	}
+	// wake up the reader, H3_NO_ERROR
+	stream.CancelRead(quic.StreamErrorCode(0x100))
 }
 
 // [3]: wait for reading client HTTP CONNECT (client indication)
@@ -203,15 +334,12 @@ func handleConnection(sess quic.Connection) {
 // when the client receives a 2xx response. From the server's
 // perspective, a session is established once it sends a 2xx response.
 // WebTransport over HTTP/3 does not support 0-RTT.
-func receiveHTTPConnectHeaderFrame(reqStream quic.Stream, publicKey, userID *string) (status int, err error) {
+//
+// The protocol version of prscd is declared by the `prscd-version` header,
+// the DefaultVersion is used if absent.
+func parseHTTPConnectHeaders(headers []qpack.HeaderField, d draft, publicKey, userID, origin *string, version *psig.Version) (status int, err error) {
 	log.Debug("[3] Receive HTTP CONNECT from client")
 
-	// read header frame which client requested
-	headers, err := readHeaderFrame(reqStream)
-	if err != nil {
-		return 401, err
-	}
-
 	// if developers need validate request header, below is the best place to do it
 	// The :protocol pseudo-header field ([RFC8441])
 	// MUST be set to webtransport.
@@ -228,9 +356,9 @@ func receiveHTTPConnectHeaderFrame(reqStream quic.Stream, publicKey, userID *str
 	// 2022/02/07 11:24:59 	[header] 5: {sec-webtransport-http3-draft02 1}
 	// 2022/02/07 11:24:59 	[header] 6: {origin https://webtransport-client.vercel.app}
 
-	var authority, path, scheme, protocol, origin, method, version string
+	var authority, path, scheme, protocol, method, draft02Header, prscdVersion string
 	for key, val := range headers {
-		log.Debug("webtrans|receiveHTTPConnectHeaderFrame", "[header] key=", key, "val=", val)
+		log.Debug("webtrans|parseHTTPConnectHeaders", "[header] key=", key, "val=", val)
 		if val.Name == ":authority" { // like prscd.yomo.dev:443
 			authority = val.Value
 		} else if val.Name == ":path" { // `/v1/webtrans?publickey=123&id=yomo-1`
@@ -242,9 +370,11 @@ func receiveHTTPConnectHeaderFrame(reqStream quic.Stream, publicKey, userID *str
 		} else if val.Name == ":protocol" { // must be webtransport
 			protocol = val.Value
 		} else if val.Name == "origin" { // origin of client
-			origin = val.Value
+			*origin = val.Value
 		} else if val.Name == "sec-webtransport-http3-draft02" { // must be 1
-			version = val.Value
+			draft02Header = val.Value
+		} else if val.Name == "prscd-version" { // like v2
+			prscdVersion = val.Value
 		}
 	}
 
@@ -252,6 +382,10 @@ func receiveHTTPConnectHeaderFrame(reqStream quic.Stream, publicKey, userID *str
 		return 401, errors.New("protocol has to be webtransport")
 	}
 
+	if d == draftNone {
+		return 400, errors.New("WebTransport is not enabled by SETTINGS of client")
+	}
+
 	if scheme != "https" {
 		return 401, errors.New("scheme has to be https")
 	}
@@ -260,22 +394,28 @@ func receiveHTTPConnectHeaderFrame(reqStream quic.Stream, publicKey, userID *str
 		return 401, errors.New("method has to be CONNECT")
 	}
 
-	if version != "1" {
+	// draft02 is declared by header, later drafts are negotiated by SETTINGS
+	if d == draft02 && draft02Header != "1" {
 		return 401, errors.New("sec-webtransport-http3-draft02 has to be 1")
 	}
 
-	// if origin need to be validated, do it here
-	log.Debug("webtrans|receiveHTTPConnectHeaderFrame", "origin", origin)
+	*version, err = psig.ParseVersion(prscdVersion)
+	if err != nil {
+		return 400, err
+	}
+
+	// origin is validated against the allowed origins of app after auth
+	log.Debug("webtrans|parseHTTPConnectHeaders", "origin", *origin)
 
 	// by checking authority, I'd like tell out the environment of service, like dev, test and prod, because I have different domains for them
-	log.Debug("webtrans|receiveHTTPConnectHeaderFrame", "authority", authority)
+	log.Debug("webtrans|parseHTTPConnectHeaders", "authority", authority)
 
 	// validate service version and auth
 	reqPath, err := url.Parse(path)
 	if err != nil {
 		return 401, errors.New("path is invalid: " + err.Error())
 	}
-	log.Debug("webtrans|receiveHTTPConnectHeaderFrame", "request Path", reqPath.Path, "QueryString", reqPath.Query())
+	log.Debug("webtrans|parseHTTPConnectHeaders", "request Path", reqPath.Path, "QueryString", reqPath.Query())
 
 	if reqPath.Path != chirp.Endpoint {
 		return 404, errors.New("path has to be /v1")
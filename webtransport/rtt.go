@@ -0,0 +1,54 @@
+package webtransport
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// connRTT is the RTT of a QUIC connection measured by quic-go, shared by
+// the peers of all its sessions.
+type connRTT struct {
+	latest   atomic.Int64
+	smoothed atomic.Int64
+	jitter   atomic.Int64
+}
+
+// get returns the RTT, zero before measured.
+func (c *connRTT) get() (latest, smoothed, jitter time.Duration) {
+	return time.Duration(c.latest.Load()), time.Duration(c.smoothed.Load()), time.Duration(c.jitter.Load())
+}
+
+// connRTTKey is the context key of connRTT of QUIC connections.
+type connRTTKey struct{}
+
+// withConnRTT is the ConnContext of quic.Transport, which attaches connRTT to
+// the context of connection, also passed to rttTracer.
+func withConnRTT(ctx context.Context, _ *quic.ClientInfo) (context.Context, error) {
+	return context.WithValue(ctx, connRTTKey{}, &connRTT{}), nil
+}
+
+// rttTracer records the RTT of connection when it is updated by the
+// congestion controller.
+func rttTracer(ctx context.Context, _ logging.Perspective, _ quic.ConnectionID) *logging.ConnectionTracer {
+	rtt, ok := ctx.Value(connRTTKey{}).(*connRTT)
+	if !ok {
+		return nil
+	}
+	return &logging.ConnectionTracer{
+		UpdatedMetrics: func(s *logging.RTTStats, _, _ logging.ByteCount, _ int) {
+			rtt.latest.Store(int64(s.LatestRTT()))
+			rtt.smoothed.Store(int64(s.SmoothedRTT()))
+			rtt.jitter.Store(int64(s.MeanDeviation()))
+		},
+	}
+}
+
+// rttOf returns the RTT of the QUIC connection, nil if not traced.
+func rttOf(sess quic.Connection) *connRTT {
+	rtt, _ := sess.Context().Value(connRTTKey{}).(*connRTT)
+	return rtt
+}
@@ -0,0 +1,180 @@
+package webtransport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/qpack"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// isExtendedConnect tells if the request establishes a WebTransport session.
+func isExtendedConnect(headers []qpack.HeaderField) bool {
+	var method, protocol string
+	for _, f := range headers {
+		switch f.Name {
+		case ":method":
+			method = f.Value
+		case ":protocol":
+			protocol = f.Value
+		}
+	}
+	return method == http.MethodConnect && protocol != ""
+}
+
+// serveHTTP serves a plain HTTP/3 request by handler, like health check
+// from monitoring tools and browsers which prefer h3 by Alt-Svc.
+func serveHTTP(sess quic.Connection, stream quic.Stream, headers []qpack.HeaderField, handler http.Handler) {
+	defer stream.Close()
+
+	req, err := newHTTPRequest(stream.Context(), headers, newDataFrameReader(stream))
+	if err != nil {
+		log.Error("webtrans|serveHTTP", "malformed request", err)
+		writeHeadersFrame(stream, http.StatusBadRequest, http.Header{})
+		return
+	}
+	req.RemoteAddr = sess.RemoteAddr().String()
+	tlsState := sess.ConnectionState().TLS
+	req.TLS = &tlsState
+	log.Debug("webtrans|serveHTTP", "method", req.Method, "path", req.URL.Path)
+
+	w := &responseWriter{
+		stream: stream,
+		header: http.Header{},
+		head:   req.Method == http.MethodHead,
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			log.Error("webtrans|serveHTTP", "panic", p, "path", req.URL.Path)
+			stream.CancelWrite(quic.StreamErrorCode(0x102)) // H3_INTERNAL_ERROR
+		}
+	}()
+
+	if handler == nil {
+		http.NotFound(w, req)
+	} else {
+		handler.ServeHTTP(w, req)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// newHTTPRequest builds the request from the headers of HTTP/3, the body is
+// read from the DATA frames of the request stream.
+func newHTTPRequest(ctx context.Context, headers []qpack.HeaderField, body io.Reader) (*http.Request, error) {
+	var method, scheme, authority, path string
+	header := http.Header{}
+	for _, f := range headers {
+		switch f.Name {
+		case ":method":
+			method = f.Value
+		case ":scheme":
+			scheme = f.Value
+		case ":authority":
+			authority = f.Value
+		case ":path":
+			path = f.Value
+		default:
+			if strings.HasPrefix(f.Name, ":") {
+				return nil, errors.New("unknown pseudo header: " + f.Name)
+			}
+			header.Add(f.Name, f.Value)
+		}
+	}
+	if method == "" || scheme == "" || path == "" {
+		return nil, errors.New(":method, :scheme and :path must be set")
+	}
+	if authority == "" {
+		authority = header.Get("Host")
+	}
+
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = scheme
+	u.Host = authority
+
+	contentLength := int64(-1)
+	if v := header.Get("Content-Length"); v != "" {
+		if contentLength, err = strconv.ParseInt(v, 10, 64); err != nil || contentLength < 0 {
+			return nil, errors.New("invalid content-length: " + v)
+		}
+	}
+
+	req := &http.Request{
+		Method:        method,
+		URL:           u,
+		Proto:         "HTTP/3.0",
+		ProtoMajor:    3,
+		Header:        header,
+		Body:          io.NopCloser(body),
+		ContentLength: contentLength,
+		Host:          authority,
+		RequestURI:    path,
+	}
+	return req.WithContext(ctx), nil
+}
+
+// responseWriter implements http.ResponseWriter and http.Flusher over a
+// HTTP/3 request stream.
+type responseWriter struct {
+	stream      quic.Stream
+	header      http.Header
+	head        bool // body of HEAD response is not written
+	wroteHeader bool
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	// connection-specific headers are not allowed in HTTP/3,
+	// https://www.rfc-editor.org/rfc/rfc9114#section-4.2
+	for _, k := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"} {
+		w.header.Del(k)
+	}
+	if err := writeHeadersFrame(w.stream, status, w.header); err != nil {
+		log.Error("webtrans|responseWriter", "writeHeadersFrame error", err)
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.header.Get("Content-Type") == "" {
+			w.header.Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.head || len(p) == 0 {
+		return len(p), nil
+	}
+	// DATA Frame {
+	// 	Type (i) = 0x00,
+	// 	Length (i),
+	// 	Data (..),
+	// }
+	buf := quicvarint.Append(make([]byte, 0, 16), frameData)
+	buf = quicvarint.Append(buf, uint64(len(p)))
+	if _, err := w.stream.Write(buf); err != nil {
+		return 0, err
+	}
+	return w.stream.Write(p)
+}
+
+// Flush implements http.Flusher, frames are written to the stream directly.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+}
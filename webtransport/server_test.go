@@ -0,0 +1,41 @@
+package webtransport
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/quic-go/qpack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsExtendedConnect(t *testing.T) {
+	assert.True(t, isExtendedConnect([]qpack.HeaderField{{Name: ":method", Value: "CONNECT"}, {Name: ":protocol", Value: "webtransport"}}))
+	assert.False(t, isExtendedConnect([]qpack.HeaderField{{Name: ":method", Value: "GET"}, {Name: ":path", Value: "/health"}}))
+}
+
+func TestNewHTTPRequest(t *testing.T) {
+	headers := []qpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: "lo.yomo.dev:8443"},
+		{Name: ":path", Value: "/v1/send?session=abc"},
+		{Name: "content-type", Value: "application/json"},
+		{Name: "content-length", Value: "2"},
+	}
+	req, err := newHTTPRequest(context.Background(), headers, strings.NewReader("{}"))
+	assert.NoError(t, err)
+	assert.Equal(t, "POST", req.Method)
+	assert.Equal(t, "/v1/send", req.URL.Path)
+	assert.Equal(t, "abc", req.URL.Query().Get("session"))
+	assert.Equal(t, "lo.yomo.dev:8443", req.Host)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, int64(2), req.ContentLength)
+	assert.Equal(t, 3, req.ProtoMajor)
+
+	_, err = newHTTPRequest(context.Background(), headers[1:], strings.NewReader(""))
+	assert.Error(t, err, ":method is missing")
+
+	_, err = newHTTPRequest(context.Background(), append(headers[:4:4], qpack.HeaderField{Name: ":foo", Value: "bar"}), strings.NewReader(""))
+	assert.Error(t, err, "unknown pseudo header")
+}
@@ -0,0 +1,134 @@
+package webtransport
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/pilarjs/prscd/chirp"
+	"github.com/pilarjs/prscd/util"
+)
+
+// sessionRouter tracks the WebTransport sessions of a QUIC connection, and
+// routes datagrams to them by Quarter Stream ID. A session is identified by
+// the stream ID of its CONNECT request.
+type sessionRouter struct {
+	mu       sync.Mutex
+	sessions map[uint64]*session // nil until the session is established
+	limit    int
+}
+
+// session is an established WebTransport session.
+type session struct {
+	peer     *chirp.Peer
+	lastSeen atomic.Int64 // unix nano of the last datagram or capsule from client
+	expired  atomic.Bool
+}
+
+// touch records the activity of client.
+func (s *session) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// idle returns the duration since the last activity of client.
+func (s *session) idle() time.Duration {
+	return time.Since(time.Unix(0, s.lastSeen.Load()))
+}
+
+func newSessionRouter(limit int) *sessionRouter {
+	return &sessionRouter{
+		sessions: make(map[uint64]*session),
+		limit:    limit,
+	}
+}
+
+// add reserves a slot for the session, returns false if the connection
+// reaches the limit of concurrent sessions.
+func (r *sessionRouter) add(sessionID uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.sessions) >= r.limit {
+		return false
+	}
+	r.sessions[sessionID] = nil
+	return true
+}
+
+// bind the peer to an established session, datagrams of the session are
+// handled by it since then.
+func (r *sessionRouter) bind(sessionID uint64, peer *chirp.Peer) *session {
+	s := &session{peer: peer}
+	s.touch()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[sessionID] = s
+	return s
+}
+
+// remove the session when its CONNECT stream is closed.
+func (r *sessionRouter) remove(sessionID uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, sessionID)
+}
+
+func (r *sessionRouter) get(sessionID uint64) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[sessionID]
+}
+
+// receiveDatagrams handles the datagrams of the QUIC connection until it is
+// closed, datagrams of unknown or not yet established sessions are dropped.
+func (r *sessionRouter) receiveDatagrams(sess quic.Connection) {
+	for {
+		msg, err := sess.ReceiveDatagram(sess.Context())
+		if err != nil {
+			// ignore errors here, sessions handle close event in their CONNECT streams
+			log.Debug("webtrans|receiveDatagrams", "err", err)
+			return
+		}
+		log.Debug("webtrans|receiveDatagrams", "ReceiveMessage", msg)
+		// be careful, msg is prefixed by the Quarter Stream ID of session
+		sessionID, payload, err := parseDatagram(msg)
+		if err != nil {
+			log.Debug("webtrans|receiveDatagrams", "drop malformed datagram", err)
+			continue
+		}
+		s := r.get(sessionID)
+		if s == nil {
+			log.Debug("webtrans|receiveDatagrams", "drop datagram of unknown session", sessionID)
+			continue
+		}
+		s.touch()
+		s.peer.HandleSignal(bytes.NewReader(payload))
+	}
+}
+
+// sessionIdleTimeout closes the sessions without datagrams or capsules from
+// client for this duration, set by env `WT_SESSION_IDLE_TIMEOUT`, default 0
+// means never, clients should send datagrams periodically if it is set.
+// Dead clients are detected by the idle timeout of QUIC connection anyway.
+var sessionIdleTimeout = sync.OnceValue(func() time.Duration {
+	return max(util.GetEnvDuration("WT_SESSION_IDLE_TIMEOUT", 0), 0)
+})
+
+// idleWheel checks the idle sessions of all connections twice per timeout.
+var idleWheel = sync.OnceValue(func() *util.TimerWheel {
+	interval := max(sessionIdleTimeout()/2, time.Millisecond)
+	return util.NewTimerWheel(min(time.Second, interval), interval)
+})
+
+// watchIdle calls expire once if the session is idle for timeout, the
+// returned timer should be stopped when the session is closed.
+func watchIdle(s *session, timeout time.Duration, expire func()) *util.Timer {
+	return idleWheel().Add(func() {
+		if s.idle() > timeout && s.expired.CompareAndSwap(false, true) {
+			// expire writes to the stream, which should not block the wheel
+			go expire()
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package webtransport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pilarjs/prscd/chirp"
+)
+
+func TestSessionRouter(t *testing.T) {
+	r := newSessionRouter(2)
+	assert.True(t, r.add(0))
+	assert.True(t, r.add(4))
+	assert.False(t, r.add(8), "should reach the limit")
+
+	// datagrams are not routed until the session is established
+	assert.Nil(t, r.get(4))
+	peer := &chirp.Peer{Sid: "127.0.0.1:1234/4"}
+	r.bind(4, peer)
+	assert.Equal(t, peer, r.get(4).peer)
+	assert.Nil(t, r.get(8))
+
+	r.remove(0)
+	assert.True(t, r.add(8), "slot should be released")
+}
+
+func TestWatchIdle(t *testing.T) {
+	t.Setenv("WT_SESSION_IDLE_TIMEOUT", "40ms")
+	r := newSessionRouter(2)
+	r.add(0)
+	r.add(4)
+	idle, active := r.bind(0, &chirp.Peer{}), r.bind(4, &chirp.Peer{})
+
+	expired := make(chan *session, 2)
+	defer watchIdle(idle, sessionIdleTimeout(), func() { expired <- idle }).Stop()
+	defer watchIdle(active, sessionIdleTimeout(), func() { expired <- active }).Stop()
+
+	deadline := time.After(150 * time.Millisecond)
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case s := <-expired:
+			assert.Equal(t, idle, s, "active session should not expire")
+		case <-tick.C:
+			active.touch()
+			continue
+		case <-deadline:
+			assert.True(t, idle.expired.Load())
+			assert.False(t, active.expired.Load())
+			return
+		}
+	}
+}